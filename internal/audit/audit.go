@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit event names
+const (
+	EVENT_LOGIN_ALLOWED         = "login_allowed"
+	EVENT_LOGIN_DENIED          = "login_denied"
+	EVENT_USER_CREATED          = "user_created"
+	EVENT_ORG_ROLE_CHANGED      = "org_role_changed"
+	EVENT_GRAFANA_ADMIN_GRANTED = "grafana_admin_granted"
+	EVENT_GRAFANA_ADMIN_REVOKED = "grafana_admin_revoked"
+	EVENT_TEAM_MEMBER_ADDED     = "team_member_added"
+)
+
+// Event is a line of the audit log. The request fields are filled from the
+// context the event is logged with.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"requestId,omitempty"`
+	TokenID   string    `json:"jti,omitempty"`
+	Issuer    string    `json:"iss,omitempty"`
+	Login     string    `json:"login,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	UserID    int64     `json:"userId,omitempty"`
+	OrgID     int64     `json:"orgId,omitempty"`
+	OldRole   string    `json:"oldRole,omitempty"`
+	NewRole   string    `json:"newRole,omitempty"`
+	Team      string    `json:"team,omitempty"`
+}
+
+// Request identifies the request and the token that caused an event.
+type Request struct {
+	RequestID string
+	TokenID   string
+	Issuer    string
+	Login     string
+	Email     string
+	Groups    []string
+}
+
+type requestKey struct{}
+
+// NewContext returns a copy of ctx that carries req.
+func NewContext(ctx context.Context, req Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// FromContext returns the Request carried by ctx.
+func FromContext(ctx context.Context) Request {
+	req, _ := ctx.Value(requestKey{}).(Request)
+	return req
+}
+
+// Logger writes audit events as JSON lines. A nil Logger discards every
+// event.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	now    func() time.Time
+}
+
+// New returns a Logger that writes to w.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w, now: time.Now}
+}
+
+// Open returns a Logger that appends to the file at path, or writes to stdout
+// when path is "-".
+func Open(path string) (*Logger, error) {
+	if path == "-" {
+		return New(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := New(f)
+	l.closer = f
+
+	return l, nil
+}
+
+// Close closes the file the Logger writes to, if any.
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+
+	return l.closer.Close()
+}
+
+// Log writes e with the request fields carried by ctx. Write errors are
+// logged, a failing audit log never fails the request.
+func (l *Logger) Log(ctx context.Context, e Event) {
+	if l == nil {
+		return
+	}
+
+	req := FromContext(ctx)
+	e.Time = l.now().UTC()
+	e.RequestID = req.RequestID
+	e.TokenID = req.TokenID
+	e.Issuer = req.Issuer
+	if e.Login == "" {
+		e.Login = req.Login
+	}
+	if e.Email == "" {
+		e.Email = req.Email
+	}
+	if e.Groups == nil {
+		e.Groups = req.Groups
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Errorf("error encoding audit event %s", e.Event)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Errorf("error writing audit event %s", e.Event)
+	}
+}
+
+// GrafanaChange logs a change applied to a Grafana user, it is meant to be
+// used as a grafana.ChangeHandler.
+func (l *Logger) GrafanaChange(ctx context.Context, change grafana.Change) {
+	e := Event{
+		UserID:  change.UserID,
+		Login:   change.Login,
+		OrgID:   change.OrgID,
+		OldRole: string(change.OldRole),
+		NewRole: string(change.NewRole),
+		Team:    change.Team,
+	}
+
+	switch change.Kind {
+	case grafana.CHANGE_USER_CREATED:
+		e.Event = EVENT_USER_CREATED
+	case grafana.CHANGE_ORG_ROLE_ADDED, grafana.CHANGE_ORG_ROLE_UPDATED:
+		e.Event = EVENT_ORG_ROLE_CHANGED
+	case grafana.CHANGE_GRAFANA_ADMIN_GRANTED:
+		e.Event = EVENT_GRAFANA_ADMIN_GRANTED
+	case grafana.CHANGE_GRAFANA_ADMIN_REVOKED:
+		e.Event = EVENT_GRAFANA_ADMIN_REVOKED
+	case grafana.CHANGE_TEAM_MEMBER_ADDED:
+		e.Event = EVENT_TEAM_MEMBER_ADDED
+	default:
+		e.Event = string(change.Kind)
+	}
+
+	l.Log(ctx, e)
+}
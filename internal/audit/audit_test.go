@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeEvents(t *testing.T, data []byte) []Event {
+	t.Helper()
+
+	events := []Event{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var e Event
+		assert.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func TestLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf)
+	logger.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	ctx := NewContext(context.Background(), Request{
+		RequestID: "req-1",
+		TokenID:   "jti-1",
+		Issuer:    "https://issuer.example.com",
+		Login:     "jhon",
+		Email:     "jhon@example.com",
+		Groups:    []string{"foo"},
+	})
+
+	logger.Log(ctx, Event{Event: EVENT_LOGIN_DENIED, Reason: "invalid_token"})
+	logger.GrafanaChange(ctx, grafana.Change{
+		Kind:    grafana.CHANGE_ORG_ROLE_UPDATED,
+		UserID:  1,
+		Login:   "jhon",
+		OrgID:   2,
+		OldRole: grafana.ROLE_VIEWER,
+		NewRole: grafana.ROLE_EDITOR,
+	})
+	logger.GrafanaChange(context.Background(), grafana.Change{Kind: grafana.CHANGE_GRAFANA_ADMIN_REVOKED, UserID: 1})
+	logger.GrafanaChange(context.Background(), grafana.Change{Kind: grafana.CHANGE_TEAM_MEMBER_ADDED, UserID: 1, OrgID: 2, Team: "oncall"})
+
+	assert.Equal(t, []Event{
+		{
+			Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Event:     EVENT_LOGIN_DENIED,
+			RequestID: "req-1",
+			TokenID:   "jti-1",
+			Issuer:    "https://issuer.example.com",
+			Login:     "jhon",
+			Email:     "jhon@example.com",
+			Groups:    []string{"foo"},
+			Reason:    "invalid_token",
+		},
+		{
+			Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Event:     EVENT_ORG_ROLE_CHANGED,
+			RequestID: "req-1",
+			TokenID:   "jti-1",
+			Issuer:    "https://issuer.example.com",
+			Login:     "jhon",
+			Email:     "jhon@example.com",
+			Groups:    []string{"foo"},
+			UserID:    1,
+			OrgID:     2,
+			OldRole:   "Viewer",
+			NewRole:   "Editor",
+		},
+		{
+			Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Event:  EVENT_GRAFANA_ADMIN_REVOKED,
+			UserID: 1,
+		},
+		{
+			Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Event:  EVENT_TEAM_MEMBER_ADDED,
+			UserID: 1,
+			OrgID:  2,
+			Team:   "oncall",
+		},
+	}, decodeEvents(t, buf.Bytes()))
+
+	// a nil logger discards events
+	var disabled *Logger
+	disabled.Log(ctx, Event{Event: EVENT_LOGIN_ALLOWED})
+	assert.NoError(t, disabled.Close())
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for range 2 {
+		logger, err := Open(path)
+		assert.NoError(t, err)
+		logger.Log(context.Background(), Event{Event: EVENT_LOGIN_ALLOWED})
+		assert.NoError(t, logger.Close())
+	}
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, decodeEvents(t, data), 2)
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	assert.Error(t, err)
+}
@@ -1,20 +1,37 @@
 package cli
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/credentials"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/filewatch"
 	"github.com/kanopy-platform/grafana-auth-proxy/internal/server"
-	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/tlsconfig"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/tracing"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
 )
 
 type RootCommand struct{}
@@ -28,18 +45,64 @@ func NewRootCommand() *cobra.Command {
 		RunE:              root.runE,
 	}
 
+	cmd.AddCommand(newValidateConfigCommand())
+	cmd.AddCommand(newExplainCommand())
+	cmd.AddCommand(newSyncCommand())
+
+	cmd.PersistentFlags().String("config", "", "Config file. Defaults to config.yaml in the working directory or in /etc/grafana-auth-proxy/")
 	cmd.PersistentFlags().String("log-level", "info", "Configure log level")
+	cmd.PersistentFlags().String("log-format", logging.FORMAT_TEXT, "Configure log format. Valid values are 'text' or 'json'")
 	cmd.PersistentFlags().String("listen-address", ":8080", "Server listen address")
+	cmd.PersistentFlags().String("admin-listen-address", "", "Admin API listen address, keep it off the proxy's public address. Disabled when empty")
+	cmd.PersistentFlags().String("metrics-listen-address", ":9090", "Prometheus metrics listen address, apart from the proxy so Grafana's /metrics stays reachable. Disabled when empty")
+	cmd.PersistentFlags().String("admin-api-token", "", "Bearer token required by the admin API. Prefer admin-api-token-file to keep it out of the process arguments and config")
+	cmd.PersistentFlags().String("admin-api-token-file", "", "File with the bearer token required by the admin API, it takes precedence over admin-api-token. Reloaded when it changes")
+	cmd.PersistentFlags().String("tls-cert-file", "", "Certificate file to serve TLS. Reloaded when it changes")
+	cmd.PersistentFlags().String("tls-key-file", "", "Certificate key file to serve TLS. Reloaded when it changes")
+	cmd.PersistentFlags().String("tls-client-ca-file", "", "CA bundle file to require and verify client certificates. Reloaded when it changes")
+	cmd.PersistentFlags().Duration("server-read-header-timeout", 10*time.Second, "Time allowed to read request headers")
+	cmd.PersistentFlags().Duration("server-read-timeout", 0, "Time allowed to read a whole request. 0 means no timeout, as it also applies to websocket sessions")
+	cmd.PersistentFlags().Duration("server-write-timeout", 0, "Time allowed to write a response. 0 means no timeout, as it also applies to long Grafana queries and websocket sessions")
+	cmd.PersistentFlags().Duration("server-idle-timeout", 120*time.Second, "Time an idle keep-alive connection is kept open")
+	cmd.PersistentFlags().Duration("readiness-check-interval", 10*time.Second, "Interval between checks of Grafana's health and admin API credentials reported by /readyz")
+	cmd.PersistentFlags().Duration("shutdown-delay", 5*time.Second, "Time between failing readiness checks and draining connections on shutdown")
+	cmd.PersistentFlags().Duration("shutdown-grace-period", 30*time.Second, "Maximum time to drain in-flight requests on shutdown")
 	cmd.PersistentFlags().Duration("http-client-timeout", 60*time.Second, "HTTP Client timeout in seconds")
 	cmd.PersistentFlags().Bool("tls-skip-verify", false, "Skip TLS certificate verification")
+	cmd.PersistentFlags().String("grafana-ca-file", "", "CA bundle file used to verify Grafana's certificate. Reloaded when it changes")
+	cmd.PersistentFlags().String("grafana-client-cert-file", "", "Client certificate file presented to Grafana. Reloaded when it changes")
+	cmd.PersistentFlags().String("grafana-client-key-file", "", "Client certificate key file presented to Grafana. Reloaded when it changes")
+	cmd.PersistentFlags().Int("proxy-max-idle-conns", 100, "Maximum number of idle connections to Grafana")
+	cmd.PersistentFlags().Int("proxy-max-idle-conns-per-host", 100, "Maximum number of idle connections to Grafana per host")
+	cmd.PersistentFlags().Duration("proxy-idle-conn-timeout", 90*time.Second, "Time an idle connection to Grafana is kept open")
+	cmd.PersistentFlags().Duration("proxy-keepalive", 30*time.Second, "Interval between keep-alive probes of connections to Grafana")
+	cmd.PersistentFlags().Duration("proxy-response-header-timeout", 0, "Time to wait for Grafana's response headers. 0 means no timeout")
+	cmd.PersistentFlags().Bool("proxy-disable-http2", false, "Disable HTTP/2 for connections to Grafana")
 	cmd.PersistentFlags().String("grafana-proxy-url", "http://grafana.example.com", "Grafana url to proxy to")
 	cmd.PersistentFlags().String("grafana-user-header", "X-WEBAUTH-USER", "Header to containing the user to authenticate")
 	cmd.PersistentFlags().String("cookie-name", "auth_token", "Cookie name with jwt token. If set will take precedence over auth header")
 	cmd.PersistentFlags().String("header-name", "", "header name with jwt token. If set will take precedence over cookie-name")
 	cmd.PersistentFlags().String("admin-user", "admin", "Admin user")
-	cmd.PersistentFlags().String("admin-password", "", "Admin password")
+	cmd.PersistentFlags().String("admin-password", "", "Admin password. Prefer admin-password-file to keep it out of the process arguments and config")
+	cmd.PersistentFlags().String("admin-password-file", "", "File with the admin password, it takes precedence over admin-password. Reloaded when it changes")
+	cmd.PersistentFlags().String("grafana-api-token-file", "", "File with a Grafana service account token used instead of the admin user and password. Reloaded when it changes")
 	cmd.PersistentFlags().String("jwt-claim-login", "email", "JWT claim to be used as user Login in Grafana. Valid values are 'email' or 'sub'")
 	cmd.PersistentFlags().String("jwt-claim-name", "sub", "JWT claim to be used as user Name in Grafana. Valid values are 'email' or 'sub'")
+	cmd.PersistentFlags().String("user-lookup", string(grafana.LOOKUP_LOGIN_THEN_EMAIL), "Strategy to find existing Grafana users. Valid values are 'login', 'email' or 'login-then-email'")
+	cmd.PersistentFlags().Int("grafana-retries", 3, "Number of retries for idempotent Grafana API calls that fail because Grafana is unavailable")
+	cmd.PersistentFlags().Duration("grafana-retry-backoff", 100*time.Millisecond, "Initial backoff between Grafana API retries, doubled on every attempt")
+	cmd.PersistentFlags().Duration("grafana-retry-max-backoff", 2*time.Second, "Maximum backoff between Grafana API retries")
+	cmd.PersistentFlags().Int("grafana-breaker-threshold", 5, "Consecutive failed Grafana API calls that open the circuit breaker. 0 disables the circuit breaker")
+	cmd.PersistentFlags().Duration("grafana-breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before Grafana is called again")
+	cmd.PersistentFlags().Bool("sync-user-profile", true, "Update the Name and Email of existing Grafana users when they differ from the token claims")
+	cmd.PersistentFlags().Bool("dry-run", false, "Read users and roles from Grafana but only log the changes that would be applied to them. Requests are proxied with the users' current roles, and Grafana's auth proxy auto_sign_up still creates the users that don't exist yet")
+	cmd.PersistentFlags().String("audit-log", "", "File the JSON audit log of logins and Grafana permission changes is appended to, '-' writes it to stdout. Disabled when empty")
+	cmd.PersistentFlags().String("denylist-file", "", "JSON list of tokens denied by every replica, like {\"jti\": ..., \"expiresAt\": ...}, usually a mounted ConfigMap. Reloaded when it changes")
+	cmd.PersistentFlags().String("denied-page-file", "", "HTML template served with a 403 to the users the config doesn't allow to log in. It gets .Login, .Reason and .RequestID. A built-in page is used when empty")
+	cmd.PersistentFlags().String("tracing-exporter", tracing.EXPORTER_NONE, "OpenTelemetry trace exporter. Valid values are 'none', 'otlp-grpc', 'otlp-http' or 'stdout'")
+	cmd.PersistentFlags().String("tracing-endpoint", "", "OTLP collector endpoint as host:port. Defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable")
+	cmd.PersistentFlags().Bool("tracing-insecure", false, "Send traces to the OTLP collector without TLS")
+	cmd.PersistentFlags().Float64("tracing-sample-ratio", 1, "Ratio of traces sampled when the incoming request is not already sampled")
 
 	return cmd
 }
@@ -49,14 +112,15 @@ func (c *RootCommand) persistentPreRunE(cmd *cobra.Command, args []string) error
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.AddConfigPath("/etc/grafana-auth-proxy/")
-	// viper.WatchConfig()
+	if configFile, _ := cmd.Flags().GetString("config"); configFile != "" {
+		viper.SetConfigFile(configFile)
+	}
 
 	err := viper.ReadInConfig()
 	if err != nil {
 		log.Error("error reading config file, ", err)
 		return err
 	}
-	log.Info("Using config file ", viper.GetViper().ConfigFileUsed())
 
 	// bind flags to viper
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
@@ -75,6 +139,12 @@ func (c *RootCommand) persistentPreRunE(cmd *cobra.Command, args []string) error
 
 	log.SetLevel(logLevel)
 
+	if err := logging.SetFormat(viper.GetString("log-format")); err != nil {
+		return err
+	}
+
+	log.Info("Using config file ", viper.GetViper().ConfigFileUsed())
+
 	return nil
 }
 
@@ -83,10 +153,20 @@ func defaultServerOptions() []server.ServerFuncOpt {
 		User: viper.GetString("grafana-user-header"),
 	}
 
+	transportConfig := server.TransportConfig{
+		MaxIdleConns:          viper.GetInt("proxy-max-idle-conns"),
+		MaxIdleConnsPerHost:   viper.GetInt("proxy-max-idle-conns-per-host"),
+		IdleConnTimeout:       viper.GetDuration("proxy-idle-conn-timeout"),
+		KeepAlive:             viper.GetDuration("proxy-keepalive"),
+		ResponseHeaderTimeout: viper.GetDuration("proxy-response-header-timeout"),
+		DisableHTTP2:          viper.GetBool("proxy-disable-http2"),
+	}
+
 	opts := []server.ServerFuncOpt{
 		server.WithCookieName(viper.GetString("cookie-name")),
 		server.WithHeaderName(viper.GetString("header-name")),
 		server.WithGrafanaResponseHeaders(responseHeaders),
+		server.WithTransportConfig(transportConfig),
 	}
 
 	return opts
@@ -100,78 +180,477 @@ func isValidClaimKey(key string) error {
 	}
 }
 
-func (c *RootCommand) runE(cmd *cobra.Command, args []string) error {
-	addr := viper.GetString("listen-address")
-	log.Infof("listening on %s", addr)
+// upstreamTLSConfig returns the TLS configuration for connections to Grafana
+// at grafanaURL when a CA bundle or a client certificate are configured, and
+// keeps it up to date with the files until ctx is done.
+func upstreamTLSConfig(ctx context.Context, grafanaURL *url.URL) (*tls.Config, error) {
+	files := tlsconfig.ClientFiles{
+		CAFile:             viper.GetString("grafana-ca-file"),
+		CertFile:           viper.GetString("grafana-client-cert-file"),
+		KeyFile:            viper.GetString("grafana-client-key-file"),
+		InsecureSkipVerify: viper.GetBool("tls-skip-verify"),
+		Host:               grafanaURL.Hostname(),
+	}
 
-	opts := defaultServerOptions()
+	if files.CAFile == "" && files.CertFile == "" && files.KeyFile == "" {
+		return nil, nil
+	}
 
-	grafanaProxyURL, err := url.Parse(viper.GetString("grafana-proxy-url"))
+	client, err := tlsconfig.NewClient(files)
 	if err != nil {
-		log.Error("grafana-proxy-url is not a proper url")
-		return err
+		return nil, err
 	}
-	opts = append(opts, server.WithGrafanaProxyURL(grafanaProxyURL))
 
-	adminPassword := viper.GetString("admin-password")
-	if adminPassword == "" {
-		log.Error("admin-password is not set")
+	go func() {
+		if err := client.Watch(ctx); err != nil {
+			log.WithError(err).Error("error watching Grafana TLS certificates")
+		}
+	}()
+
+	return client.Config(), nil
+}
+
+// serverTLSConfig returns the TLS configuration to serve TLS when a server
+// certificate is configured, and keeps it up to date with the files until ctx
+// is done.
+func serverTLSConfig(ctx context.Context) (*tls.Config, error) {
+	files := tlsconfig.ServerFiles{
+		CertFile:     viper.GetString("tls-cert-file"),
+		KeyFile:      viper.GetString("tls-key-file"),
+		ClientCAFile: viper.GetString("tls-client-ca-file"),
+	}
+
+	if files.CertFile == "" && files.KeyFile == "" && files.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	tlsServer, err := tlsconfig.NewServer(files)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := tlsServer.Watch(ctx); err != nil {
+			log.WithError(err).Error("error watching server TLS certificates")
+		}
+	}()
+
+	return tlsServer.Config(), nil
+}
+
+// watchAuthz reloads the group mappings and rules of s every time the
+// config file changes until ctx is done. An invalid config file keeps the
+// previous ones. Other settings still require a restart.
+func watchAuthz(ctx context.Context, configFile string, settings map[string]bool, s *server.Server) {
+	err := filewatch.Watch(ctx, []string{configFile}, func() {
+		if err := reloadAuthz(configFile, settings, s); err != nil {
+			log.WithError(err).Error("error reloading groups and rules from config, keeping the previous ones")
+		}
+	})
+	if err != nil {
+		log.WithError(err).Error("error watching config file")
+	}
+}
+
+// reloadAuthz replaces the group mappings and rules of s with the ones in
+// the config file. The previous ones are kept when an error is returned.
+func reloadAuthz(configFile string, settings map[string]bool, s *server.Server) error {
+	authz, err := loadAuthz(configFile, settings)
+	if err != nil {
 		return err
 	}
 
-	loginKey := viper.GetString("jwt-claim-login")
-	err = isValidClaimKey(loginKey)
+	// a file that is being written in place can be read truncated, an
+	// empty config would remove the roles of every user on their next
+	// login
+	current := s.Authz()
+	if len(authz.Groups) == 0 && len(authz.Rules) == 0 && (len(current.Groups) > 0 || len(current.Rules) > 0) {
+		return errors.New("reloaded config has no groups or rules. Restart to remove every group and rule")
+	}
+
+	if reflect.DeepEqual(authz, current) {
+		log.Debug("config file changed, groups and rules are unchanged")
+		return nil
+	}
+
+	s.SetAuthz(authz)
+	log.Infof("reloaded %d groups and %d rules from config", len(authz.Groups), len(authz.Rules))
+	log.Debugf("groups configuration map: %v", authz.Groups)
+
+	return nil
+}
+
+// serveAdmin serves the admin API of s on addr, authenticated with token,
+// until ctx is done.
+func serveAdmin(ctx context.Context, addr string, s *server.Server, token *credentials.Secret) {
+	serveInternal(ctx, "admin API", addr, s.AdminHandler(token.Value))
+}
+
+// serveMetrics serves the metrics of s on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string, s *server.Server) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+
+	serveInternal(ctx, "metrics", addr, mux)
+}
+
+// serveInternal serves handler on addr, a listener that is not exposed with
+// the proxy, until ctx is done.
+func serveInternal(ctx context.Context, name, addr string, handler http.Handler) {
+	internalServer := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: viper.GetDuration("server-read-header-timeout"),
+	}
+
+	go func() {
+		<-ctx.Done()
+		// these requests are short, they are not drained
+		if err := internalServer.Close(); err != nil {
+			log.Errorf("error closing %s listener, %v", name, err)
+		}
+	}()
+
+	log.Infof("%s listening on %s", name, addr)
+	if err := internalServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Errorf("error serving %s", name)
+	}
+}
+
+func (c *RootCommand) runE(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	configFile := viper.ConfigFileUsed()
+	settings := settingNames(cmd)
+
+	authz, err := validateConfig(configFile, settings)
 	if err != nil {
-		log.WithError(err)
+		log.Errorf("invalid config in %s:\n%s", configFile, err)
+		// the problems are already logged
+		cmd.SilenceUsage = true
+		return errInvalidConfig
+	}
+
+	addr := viper.GetString("listen-address")
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:    viper.GetString("tracing-exporter"),
+		Endpoint:    viper.GetString("tracing-endpoint"),
+		Insecure:    viper.GetBool("tracing-insecure"),
+		SampleRatio: viper.GetFloat64("tracing-sample-ratio"),
+	})
+	if err != nil {
+		log.Error("error setting up tracing, ", err)
 		return err
 	}
+	defer func() {
+		// flush the spans of the requests drained on shutdown
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error("error flushing traces, ", err)
+		}
+	}()
+
+	opts := defaultServerOptions()
+
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	opts = append(opts, server.WithMetricsRegistry(metricsRegistry))
+
+	var auditLogger *audit.Logger
+	if path := viper.GetString("audit-log"); path != "" {
+		auditLogger, err = audit.Open(path)
+		if err != nil {
+			log.Error("error opening audit log, ", err)
+			return err
+		}
+		defer auditLogger.Close()
+
+		opts = append(opts, server.WithAuditLogger(auditLogger))
+	}
 
-	nameKey := viper.GetString("jwt-claim-name")
-	err = isValidClaimKey(nameKey)
+	grafanaProxyURL, err := url.Parse(viper.GetString("grafana-proxy-url"))
 	if err != nil {
-		log.WithError(err)
+		log.Error("grafana-proxy-url is not a proper url")
 		return err
 	}
+	opts = append(opts, server.WithGrafanaProxyURL(grafanaProxyURL))
 
 	claimsMap := server.GrafanaClaimsConfig{
-		Login: loginKey,
-		Name:  nameKey,
+		Login: viper.GetString("jwt-claim-login"),
+		Name:  viper.GetString("jwt-claim-name"),
 	}
 	opts = append(opts, server.WithGrafanaClaimsConfig(claimsMap))
 
-	grafanaHTTPClient := http.DefaultClient
-	grafanaHTTPClient.Timeout = viper.GetDuration("http-client-timeout")
+	upstreamTLS, err := upstreamTLSConfig(ctx, grafanaProxyURL)
+	if err != nil {
+		log.Error("error loading Grafana TLS certificates, ", err)
+		return err
+	}
 
-	grafanaConfig := gapi.Config{
-		BasicAuth: url.UserPassword(viper.GetString("admin-user"), adminPassword),
-		Client:    grafanaHTTPClient,
+	if upstreamTLS != nil {
+		opts = append(opts, server.WithUpstreamTLSConfig(upstreamTLS))
 	}
 
-	grafanaClient, err := grafana.NewClient(grafanaProxyURL, grafanaConfig)
+	grafanaClientOpts := []grafana.ClientFuncOpt{
+		grafana.WithMetrics(metricsRegistry),
+	}
+	switch {
+	case viper.GetBool("dry-run"):
+		// the audit log only has changes that were applied
+		log.Warn("dry run, changes to Grafana users are logged but not applied")
+		grafanaClientOpts = append(grafanaClientOpts, grafana.WithDryRun(), grafana.WithChangeHandler(grafana.LogChange))
+	case auditLogger != nil:
+		grafanaClientOpts = append(grafanaClientOpts, grafana.WithChangeHandler(auditLogger.GrafanaChange))
+	}
+
+	grafanaClient, err := newGrafanaClient(ctx, grafanaProxyURL, upstreamTLS, grafanaClientOpts...)
 	if err != nil {
 		log.Error("error creating Grafana client, ", err)
 		return err
 	}
 	opts = append(opts, server.WithGrafanaClient(grafanaClient))
 
-	groups := config.Groups{}
-	if err := viper.UnmarshalKey("groups", &groups); err != nil {
-		log.Error("error parsing groups settings in config, ", err)
-		return err
+	opts = append(opts, server.WithConfigAuthz(authz))
+
+	if path := viper.GetString("denied-page-file"); path != "" {
+		page, err := loadDeniedPage(path)
+		if err != nil {
+			log.Error("error loading the denied page, ", err)
+			return err
+		}
+		opts = append(opts, server.WithDeniedPage(page))
 	}
 
-	opts = append(opts, server.WithConfigGroups(groups))
-	log.Debugf("groups configuration map: %v", groups)
+	// the server is only referenced once it is created
+	var s *server.Server
+	opts = append(opts, server.WithConfigReloader(func() error {
+		return reloadAuthz(configFile, settings, s)
+	}))
+	log.Debugf("groups configuration map: %v", authz.Groups)
 
 	skipTLSVerify := viper.GetBool("tls-skip-verify")
 	if skipTLSVerify {
 		opts = append(opts, server.SkipTLSVerify())
 	}
 
-	s, err := server.New(opts...)
+	s, err = server.New(opts...)
 	if err != nil {
 		return err
 	}
 
-	return http.ListenAndServe(addr, s)
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: viper.GetDuration("server-read-header-timeout"),
+		ReadTimeout:       viper.GetDuration("server-read-timeout"),
+		WriteTimeout:      viper.GetDuration("server-write-timeout"),
+		IdleTimeout:       viper.GetDuration("server-idle-timeout"),
+	}
+
+	serverTLS, err := serverTLSConfig(ctx)
+	if err != nil {
+		log.Error("error loading server TLS certificates, ", err)
+		return err
+	}
+	httpServer.TLSConfig = serverTLS
+
+	go watchAuthz(ctx, configFile, settings, s)
+	if path := viper.GetString("denylist-file"); path != "" {
+		tokens, err := loadDenylist(path)
+		if err != nil {
+			log.Error("error loading the denylist, ", err)
+			return err
+		}
+		s.SetSharedDenylist(tokens)
+
+		go watchDenylist(ctx, path, s)
+	}
+	if addr := viper.GetString("admin-listen-address"); addr != "" {
+		adminToken, err := credentials.NewSecret(viper.GetString("admin-api-token"), viper.GetString("admin-api-token-file"))
+		if err != nil {
+			log.Error("error loading the admin API token, ", err)
+			return err
+		}
+
+		go func() {
+			if err := adminToken.Watch(ctx); err != nil {
+				log.WithError(err).Error("error watching the admin API token")
+			}
+		}()
+
+		go serveAdmin(ctx, addr, s, adminToken)
+	}
+	if addr := viper.GetString("metrics-listen-address"); addr != "" {
+		go serveMetrics(ctx, addr, s)
+	}
+	go s.RunReadinessChecks(ctx, viper.GetDuration("readiness-check-interval"))
+
+	return serve(ctx, httpServer, s)
+}
+
+// newGrafanaClient returns a client of Grafana's admin API configured from
+// the settings, with opts applied after them. The credentials files are
+// reloaded until ctx is done.
+func newGrafanaClient(ctx context.Context, grafanaURL *url.URL, upstreamTLS *tls.Config, opts ...grafana.ClientFuncOpt) (*grafana.Client, error) {
+	creds, err := credentials.New(credentials.Config{
+		User:         viper.GetString("admin-user"),
+		Password:     viper.GetString("admin-password"),
+		PasswordFile: viper.GetString("admin-password-file"),
+		TokenFile:    viper.GetString("grafana-api-token-file"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := creds.Watch(ctx); err != nil {
+			log.WithError(err).Error("error watching Grafana credentials")
+		}
+	}()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if upstreamTLS != nil {
+		transport.TLSClientConfig = upstreamTLS
+	}
+
+	// the credentials are set on every request, instead of in gapi.Config,
+	// so they can be rotated
+	grafanaConfig := gapi.Config{
+		Client: &http.Client{
+			Timeout:   viper.GetDuration("http-client-timeout"),
+			Transport: creds.Transport(transport),
+		},
+	}
+
+	grafanaClientOpts := []grafana.ClientFuncOpt{
+		grafana.WithLookupStrategy(grafana.LookupStrategy(viper.GetString("user-lookup"))),
+		grafana.WithRetry(grafana.RetryConfig{
+			MaxRetries:     viper.GetInt("grafana-retries"),
+			InitialBackoff: viper.GetDuration("grafana-retry-backoff"),
+			MaxBackoff:     viper.GetDuration("grafana-retry-max-backoff"),
+		}),
+		grafana.WithCircuitBreaker(grafana.BreakerConfig{
+			Threshold: viper.GetInt("grafana-breaker-threshold"),
+			Cooldown:  viper.GetDuration("grafana-breaker-cooldown"),
+		}),
+	}
+	if !viper.GetBool("sync-user-profile") {
+		grafanaClientOpts = append(grafanaClientOpts, grafana.WithoutUserProfileSync())
+	}
+
+	return grafana.NewClient(grafanaURL, grafanaConfig, append(grafanaClientOpts, opts...)...)
+}
+
+// serve runs httpServer until ctx is done and then shuts it down gracefully:
+// readiness fails first so the server is removed from the load balancers, and
+// in-flight requests and upgraded connections, like Grafana Live websockets,
+// are drained within the grace period.
+func serve(ctx context.Context, httpServer *http.Server, s *server.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		log.Infof("listening on %s", httpServer.Addr)
+
+		if httpServer.TLSConfig != nil {
+			errCh <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("shutting down, failing readiness checks")
+	s.Drain()
+
+	// give the load balancers time to notice the failing readiness checks
+	// before connections are closed
+	time.Sleep(viper.GetDuration("shutdown-delay"))
+
+	gracePeriod := viper.GetDuration("shutdown-grace-period")
+	log.Infof("draining connections for up to %s", gracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Error("error draining connections, ", err)
+		return err
+	}
+
+	// Shutdown doesn't wait for hijacked connections
+	if err := s.WaitUpgraded(shutdownCtx); err != nil {
+		log.Warn("closed the upgraded connections still open after the grace period")
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Info("shutdown complete")
+
+	return nil
+}
+
+// loadDeniedPage parses the HTML template served to the users the config
+// doesn't allow to log in, and checks it renders.
+// loadDenylist reads the tokens denied by every replica from a JSON list of
+// server.DeniedToken.
+func loadDenylist(path string) ([]server.DeniedToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty file is usually being written, an empty list is []
+	var tokens []server.DeniedToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	for i, token := range tokens {
+		if token.ID == "" {
+			return nil, fmt.Errorf("error parsing %s: token %d has no jti", path, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+// watchDenylist reloads the tokens denied by every replica when the denylist
+// file changes, until ctx is done.
+func watchDenylist(ctx context.Context, path string, s *server.Server) {
+	err := filewatch.Watch(ctx, []string{path}, func() {
+		tokens, err := loadDenylist(path)
+		if err != nil {
+			log.WithError(err).Error("error reloading the denylist, keeping the previous one")
+			return
+		}
+
+		s.SetSharedDenylist(tokens)
+		log.Infof("reloaded %d denied tokens", len(tokens))
+	})
+	if err != nil {
+		log.WithError(err).Error("error watching the denylist file")
+	}
+}
+
+func loadDeniedPage(path string) (*template.Template, error) {
+	page, err := template.New(filepath.Base(path)).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := server.ValidateDeniedPage(page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
 }
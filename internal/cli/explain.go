@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/server"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+)
+
+func newExplainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "explain",
+		Short: "Show the user, groups and roles a token would get in Grafana, without calling Grafana",
+		Long: `Show the decoded claims of a token, the Grafana login, name and email taken
+from them, the groups and rules of the config that match and the resulting
+role per org, teams and Grafana admin flag. The token is read from --token or
+from stdin.
+
+The token signature is not verified, as the proxy relies on the Ingress for it.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token, _ := cmd.Flags().GetString("token")
+			if token == "" || token == "-" {
+				data, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("error reading token from stdin: %w", err)
+				}
+				token = string(data)
+			}
+
+			token = strings.TrimSpace(token)
+			if token == "" {
+				return errors.New("no token, use --token or pipe it to stdin")
+			}
+
+			authz, err := loadAuthz(viper.ConfigFileUsed(), settingNames(cmd))
+			if err != nil {
+				return fmt.Errorf("invalid config in %s:\n%w", viper.ConfigFileUsed(), err)
+			}
+
+			claimsConfig := server.GrafanaClaimsConfig{
+				Login: viper.GetString("jwt-claim-login"),
+				Name:  viper.GetString("jwt-claim-name"),
+			}
+
+			return explain(cmd.OutOrStdout(), token, claimsConfig, authz)
+		},
+	}
+
+	cmd.Flags().String("token", "", "JWT to explain. Read from stdin when empty or '-'")
+
+	return cmd
+}
+
+// explain writes to w what the proxy would do with token, resolving the
+// roles the same way a login does.
+func explain(w io.Writer, token string, claimsConfig server.GrafanaClaimsConfig, authz config.Authz) error {
+	claims, err := jwt.TokenClaims(token)
+	if err != nil {
+		return fmt.Errorf("error reading claims from token: %w", err)
+	}
+
+	decoded, err := json.MarshalIndent(claims.Raw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	login, name, email := claimsConfig.Identity(claims)
+
+	fmt.Fprintf(w, "Claims:\n%s\n\n", decoded)
+	fmt.Fprintf(w, "Login: %s (%s claim)\n", login, claimsConfig.Login)
+	fmt.Fprintf(w, "Name:  %s (%s claim)\n", name, claimsConfig.Name)
+	fmt.Fprintf(w, "Email: %s\n\n", email)
+
+	if claims.Subject == "" {
+		fmt.Fprintf(w, "The sub claim is empty, the login would be denied.\n\n")
+	}
+
+	resolution := authz.Resolve(claims.Map())
+
+	// the groups of the claims are listed by the config or match a pattern
+	validUserGroups := config.ValidUserGroups(claims.Groups, authz.Groups)
+
+	var matched, unmatched []string
+	for _, group := range claims.Groups {
+		if _, ok := validUserGroups[group]; ok {
+			matched = append(matched, group)
+		} else {
+			unmatched = append(unmatched, group)
+		}
+	}
+	sort.Strings(matched)
+
+	fmt.Fprintf(w, "Matched groups: %s\n", listOrNone(matched))
+	fmt.Fprintf(w, "Groups not in config: %s\n", listOrNone(unmatched))
+	fmt.Fprintf(w, "Matched rules: %s\n\n", listOrNone(resolution.Rules))
+
+	if resolution.Denied != "" {
+		fmt.Fprintf(w, "Denied, %s: the login would be denied and the user would not be created.\n", resolution.Denial())
+		return nil
+	}
+
+	if resolution.Default {
+		fmt.Fprintf(w, "No groups or rules grant anything, the default grants apply.\n\n")
+	}
+
+	orgRoles, isAdmin := grafana.ResolveOrgRoles(resolution.Groups)
+	namedOrgRoles := grafana.ResolveNamedOrgRoles(resolution.Groups)
+
+	orgIDs := make([]int64, 0, len(orgRoles))
+	for orgID := range orgRoles {
+		orgIDs = append(orgIDs, orgID)
+	}
+	sort.Slice(orgIDs, func(i, j int) bool { return orgIDs[i] < orgIDs[j] })
+
+	orgNames := make([]string, 0, len(namedOrgRoles))
+	for orgName := range namedOrgRoles {
+		orgNames = append(orgNames, orgName)
+	}
+	sort.Strings(orgNames)
+
+	fmt.Fprintln(w, "Org roles:")
+	if len(orgIDs) == 0 && len(orgNames) == 0 {
+		fmt.Fprintln(w, "  none, the user only gets Grafana's default org and role")
+	}
+	for _, orgID := range orgIDs {
+		fmt.Fprintf(w, "  org %d: %s\n", orgID, orgRoles[orgID])
+	}
+	// orgs referenced by name only get a role when they exist in Grafana
+	for _, orgName := range orgNames {
+		fmt.Fprintf(w, "  org %q: %s\n", orgName, namedOrgRoles[orgName])
+	}
+
+	var teams []string
+	seen := make(map[config.Team]bool)
+	for _, group := range resolution.Groups {
+		for _, team := range group.Teams {
+			if seen[team] {
+				continue
+			}
+			seen[team] = true
+
+			org := fmt.Sprintf("org %d", team.OrgID)
+			if team.OrgName != "" {
+				org = fmt.Sprintf("org %q", team.OrgName)
+			}
+			teams = append(teams, fmt.Sprintf("%q in %s", team.Name, org))
+		}
+	}
+	sort.Strings(teams)
+
+	fmt.Fprintf(w, "Teams: %s\n", listOrNone(teams))
+	fmt.Fprintf(w, "Grafana admin: %t\n", isAdmin)
+
+	return nil
+}
+
+func listOrNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,359 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/server"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+)
+
+var errSyncFailed = errors.New("some users failed to sync")
+
+// syncResult is the outcome of the sync of one user.
+type syncResult struct {
+	login   string
+	changes []grafana.Change
+	// denial is why the config denied the user, which is never created
+	denial string
+	err    error
+}
+
+type changesKey struct{}
+
+func newSyncCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync <file>",
+		Short: "Create users in Grafana and set their roles from a CSV or JSON file, before their first login",
+		Long: `Create users in Grafana and set their Grafana admin flag, roles per org and
+teams from their groups and the rules, the same way a login does.
+
+A JSON file is a list of objects with the claims of the users' tokens:
+
+  [{"sub": "jdoe", "email": "jdoe@example.com", "groups": ["foo", "bar"]}]
+
+A CSV file has a header with sub, email and groups columns, other columns are
+claims for the rules. Groups are separated by semicolons:
+
+  sub,email,groups
+  jdoe,jdoe@example.com,foo;bar`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGTERM, syscall.SIGINT)
+			defer stop()
+
+			users, err := readSyncUsers(args[0])
+			if err != nil {
+				return err
+			}
+
+			authz, err := validateConfig(viper.ConfigFileUsed(), settingNames(cmd))
+			if err != nil {
+				return fmt.Errorf("invalid config in %s:\n%w", viper.ConfigFileUsed(), err)
+			}
+
+			dryRun := viper.GetBool("dry-run")
+			concurrency, _ := cmd.Flags().GetInt("concurrency")
+			if concurrency < 1 {
+				return errors.New("concurrency must be greater than 0")
+			}
+
+			grafanaURL, err := url.Parse(viper.GetString("grafana-proxy-url"))
+			if err != nil {
+				return fmt.Errorf("grafana-proxy-url is not a proper url: %w", err)
+			}
+
+			upstreamTLS, err := upstreamTLSConfig(ctx, grafanaURL)
+			if err != nil {
+				return fmt.Errorf("error loading Grafana TLS certificates: %w", err)
+			}
+
+			handlers := []grafana.ChangeHandler{collectChange}
+			if path := viper.GetString("audit-log"); path != "" && !dryRun {
+				auditLogger, err := audit.Open(path)
+				if err != nil {
+					return fmt.Errorf("error opening audit log: %w", err)
+				}
+				defer auditLogger.Close()
+
+				handlers = append(handlers, auditLogger.GrafanaChange)
+			}
+
+			opts := []grafana.ClientFuncOpt{
+				grafana.WithChangeHandler(func(ctx context.Context, change grafana.Change) {
+					for _, handler := range handlers {
+						handler(ctx, change)
+					}
+				}),
+			}
+			if dryRun {
+				opts = append(opts, grafana.WithDryRun())
+			}
+
+			grafanaClient, err := newGrafanaClient(ctx, grafanaURL, upstreamTLS, opts...)
+			if err != nil {
+				return fmt.Errorf("error creating Grafana client: %w", err)
+			}
+
+			claimsConfig := server.GrafanaClaimsConfig{
+				Login: viper.GetString("jwt-claim-login"),
+				Name:  viper.GetString("jwt-claim-name"),
+			}
+
+			results := syncUsers(ctx, grafanaClient, claimsConfig, authz, users, concurrency)
+
+			return reportSync(cmd.OutOrStdout(), results, dryRun)
+		},
+	}
+
+	cmd.Flags().Int("concurrency", 4, "Number of users synced at the same time")
+
+	return cmd
+}
+
+// collectChange appends change to the changes of the user being synced in
+// ctx.
+func collectChange(ctx context.Context, change grafana.Change) {
+	if changes, ok := ctx.Value(changesKey{}).(*[]grafana.Change); ok {
+		*changes = append(*changes, change)
+	}
+}
+
+// syncUsers syncs users with Grafana, at most concurrency at a time, and
+// returns the result of each user in the same order.
+func syncUsers(ctx context.Context, client *grafana.Client, claimsConfig server.GrafanaClaimsConfig, authz config.Authz, users []jwt.Claims, concurrency int) []syncResult {
+	results := make([]syncResult, len(users))
+
+	var g errgroup.Group
+	g.SetLimit(concurrency)
+
+	for i := range users {
+		claims := &users[i]
+		result := &results[i]
+
+		g.Go(func() error {
+			login, name, email := claimsConfig.Identity(claims)
+			result.login = login
+
+			resolution := authz.Resolve(claims.Map())
+			result.denial = resolution.Denial()
+
+			switch {
+			case claims.Subject == "":
+				result.err = errors.New("sub is empty")
+			case login == "":
+				result.err = fmt.Errorf("%s claim of the login is empty", claimsConfig.Login)
+			case ctx.Err() != nil:
+				result.err = ctx.Err()
+			case result.denial != "":
+			default:
+				// changes are only appended by this goroutine
+				userCtx := context.WithValue(ctx, changesKey{}, &result.changes)
+				userCtx = logging.NewContext(userCtx, log.Fields{"login": login})
+
+				_, _, result.err = client.SyncUser(userCtx, login, name, email, resolution.Groups)
+			}
+
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+
+	return results
+}
+
+// reportSync writes a line per user with its changes and a summary, and
+// returns errSyncFailed when any user failed.
+func reportSync(w io.Writer, results []syncResult, dryRun bool) error {
+	if dryRun {
+		fmt.Fprintln(w, "Dry run, the changes are not applied to Grafana.")
+	}
+
+	var created, changed, unchanged, denied, failed int
+	for i, result := range results {
+		login := result.login
+		if login == "" {
+			login = fmt.Sprintf("user %d", i+1)
+		}
+
+		switch {
+		case result.err != nil:
+			failed++
+			fmt.Fprintf(w, "%s: error: %v\n", login, result.err)
+		case result.denial != "":
+			denied++
+			fmt.Fprintf(w, "%s: %s\n", login, result.denial)
+		case len(result.changes) == 0:
+			unchanged++
+			fmt.Fprintf(w, "%s: unchanged\n", login)
+		default:
+			if result.changes[0].Kind == grafana.CHANGE_USER_CREATED {
+				created++
+			} else {
+				changed++
+			}
+
+			fmt.Fprintf(w, "%s: %s\n", login, describeChanges(result.changes))
+		}
+	}
+
+	fmt.Fprintf(w, "%d users: %d created, %d changed, %d unchanged, %d denied, %d failed\n",
+		len(results), created, changed, unchanged, denied, failed)
+
+	if failed > 0 {
+		return errSyncFailed
+	}
+
+	return nil
+}
+
+func describeChanges(changes []grafana.Change) string {
+	// the user is created first, and orgs are listed in order
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].OrgID < changes[j].OrgID
+	})
+
+	descriptions := make([]string, len(changes))
+	for i, change := range changes {
+		switch change.Kind {
+		case grafana.CHANGE_USER_CREATED:
+			descriptions[i] = "created"
+		case grafana.CHANGE_ORG_ROLE_ADDED:
+			descriptions[i] = fmt.Sprintf("added to org %d as %s", change.OrgID, change.NewRole)
+		case grafana.CHANGE_ORG_ROLE_UPDATED:
+			descriptions[i] = fmt.Sprintf("org %d role changed from %s to %s", change.OrgID, change.OldRole, change.NewRole)
+		case grafana.CHANGE_GRAFANA_ADMIN_GRANTED:
+			descriptions[i] = "Grafana admin granted"
+		case grafana.CHANGE_GRAFANA_ADMIN_REVOKED:
+			descriptions[i] = "Grafana admin revoked"
+		case grafana.CHANGE_TEAM_MEMBER_ADDED:
+			descriptions[i] = fmt.Sprintf("added to team %q of org %d", change.Team, change.OrgID)
+		default:
+			descriptions[i] = string(change.Kind)
+		}
+	}
+
+	return strings.Join(descriptions, ", ")
+}
+
+// readSyncUsers reads the claims of the users to sync from a CSV or JSON
+// file.
+func readSyncUsers(path string) ([]jwt.Claims, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// every claim is kept for the rules
+		raw := []map[string]interface{}{}
+		if err := json.NewDecoder(f).Decode(&raw); err != nil {
+			return nil, fmt.Errorf("error reading users from %s: %w", path, err)
+		}
+
+		users := make([]jwt.Claims, len(raw))
+		for i := range raw {
+			data, err := json.Marshal(raw[i])
+			if err != nil {
+				return nil, err
+			}
+
+			if err := json.Unmarshal(data, &users[i]); err != nil {
+				return nil, fmt.Errorf("error reading user %d from %s: %w", i+1, path, err)
+			}
+			users[i].Raw = raw[i]
+		}
+
+		return users, nil
+	case ".csv":
+		users, err := readSyncUsersCSV(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading users from %s: %w", path, err)
+		}
+
+		return users, nil
+	}
+
+	return nil, fmt.Errorf("users file %s must be a .csv or .json file", path)
+}
+
+func readSyncUsersCSV(r io.Reader) ([]jwt.Claims, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("header is missing")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if _, ok := columns["sub"]; !ok {
+		return nil, errors.New("sub column is missing")
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	users := make([]jwt.Claims, 0, len(records)-1)
+	for _, record := range records[1:] {
+		claims := jwt.Claims{Email: column(record, "email")}
+		claims.Subject = column(record, "sub")
+
+		for _, group := range strings.Split(column(record, "groups"), ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				claims.Groups = append(claims.Groups, group)
+			}
+		}
+
+		// the other columns are claims for the rules
+		claims.Raw = claims.Map()
+		for name := range columns {
+			switch name {
+			case "sub", "email", "groups":
+				continue
+			}
+
+			if value := column(record, name); value != "" {
+				claims.Raw[name] = value
+			}
+		}
+
+		users = append(users, claims)
+	}
+
+	return users, nil
+}
@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+)
+
+var errInvalidConfig = errors.New("config is not valid")
+
+func newValidateConfigCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate-config",
+		Short: "Validate the config file and settings and report every problem found",
+		Args:  cobra.NoArgs,
+		// the report already explains what is wrong
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile := viper.ConfigFileUsed()
+
+			authz, err := validateConfig(configFile, settingNames(cmd))
+			if err != nil {
+				problems, ok := err.(config.Problems)
+				if !ok {
+					return err
+				}
+
+				// problems without a line come from the settings, which can
+				// also be set with flags or environment variables
+				for _, problem := range problems {
+					if problem.Line > 0 {
+						fmt.Fprintf(cmd.ErrOrStderr(), "%s: ", configFile)
+					}
+					fmt.Fprintln(cmd.ErrOrStderr(), problem)
+				}
+
+				return errInvalidConfig
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: ok, %d groups, %d rules, %d deny groups, %d required groups, %d allowed email domains\n",
+				configFile, len(authz.Groups), len(authz.Rules), len(authz.DenyGroups), len(authz.RequiredGroups), len(authz.AllowedEmailDomains))
+
+			return nil
+		},
+	}
+}
+
+// settingNames returns the names of the settings that can be set in the
+// config file, which are the names of the flags.
+func settingNames(cmd *cobra.Command) map[string]bool {
+	settings := make(map[string]bool)
+	cmd.Root().PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		settings[flag.Name] = true
+	})
+
+	// the config file can't point to another config file
+	delete(settings, "config")
+
+	return settings
+}
+
+// validateConfig validates the groups and rules in the config file and the
+// settings, from flags, environment and config file, and returns the groups
+// and rules. All the problems found are returned as config.Problems.
+func validateConfig(configFile string, settings map[string]bool) (config.Authz, error) {
+	var problems config.Problems
+
+	authz, err := loadAuthz(configFile, settings)
+	if err != nil {
+		fileProblems, ok := err.(config.Problems)
+		if !ok {
+			return config.Authz{}, err
+		}
+
+		problems = append(problems, fileProblems...)
+	}
+
+	problems = append(problems, validateSettings()...)
+
+	if len(problems) > 0 {
+		return config.Authz{}, problems
+	}
+
+	return authz, nil
+}
+
+// loadAuthz reads and validates the group mappings and rules from the config
+// file. YAML and JSON files are read strictly, with line numbers in the
+// problems found.
+func loadAuthz(configFile string, settings map[string]bool) (config.Authz, error) {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml", ".json":
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return config.Authz{}, err
+		}
+
+		return config.Parse(data, settings)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return config.Authz{}, err
+	}
+
+	authz := config.Authz{Groups: config.Groups{}}
+	if err := v.UnmarshalKey("groups", &authz.Groups); err != nil {
+		return config.Authz{}, err
+	}
+
+	if err := v.UnmarshalKey("rules", &authz.Rules); err != nil {
+		return config.Authz{}, err
+	}
+
+	restrictions := map[string]*[]string{
+		"denyGroups":          &authz.DenyGroups,
+		"requiredGroups":      &authz.RequiredGroups,
+		"allowedEmailDomains": &authz.AllowedEmailDomains,
+	}
+	for key, list := range restrictions {
+		if err := v.UnmarshalKey(key, list); err != nil {
+			return config.Authz{}, err
+		}
+	}
+
+	if err := v.UnmarshalKey("defaultGrants", &authz.DefaultGrants); err != nil {
+		return config.Authz{}, err
+	}
+
+	if err := authz.Validate(); err != nil {
+		// the errors are prefixed with the group or rule they belong to
+		return config.Authz{}, config.Problems{{Message: err.Error()}}
+	}
+
+	return authz, nil
+}
+
+// validateSettings checks the settings that are required, have a limited set
+// of values or only make sense together.
+func validateSettings() config.Problems {
+	var problems config.Problems
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, config.Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	password, passwordFile, tokenFile := viper.GetString("admin-password"), viper.GetString("admin-password-file"), viper.GetString("grafana-api-token-file")
+	switch {
+	case password == "" && passwordFile == "" && tokenFile == "":
+		add("admin-password", "admin-password, admin-password-file or grafana-api-token-file is required")
+	case tokenFile != "" && (password != "" || passwordFile != ""):
+		add("grafana-api-token-file", "can't be used with admin-password or admin-password-file")
+	}
+
+	for _, key := range []string{"jwt-claim-login", "jwt-claim-name"} {
+		if err := isValidClaimKey(viper.GetString(key)); err != nil {
+			add(key, "valid values are \"sub\" or \"email\", got %q", viper.GetString(key))
+		}
+	}
+
+	switch grafana.LookupStrategy(viper.GetString("user-lookup")) {
+	case grafana.LOOKUP_LOGIN, grafana.LOOKUP_EMAIL, grafana.LOOKUP_LOGIN_THEN_EMAIL:
+	default:
+		add("user-lookup", "valid values are \"login\", \"email\" or \"login-then-email\", got %q", viper.GetString("user-lookup"))
+	}
+
+	pairs := [][2]string{
+		{"tls-cert-file", "tls-key-file"},
+		{"grafana-client-cert-file", "grafana-client-key-file"},
+	}
+	for _, pair := range pairs {
+		if (viper.GetString(pair[0]) == "") != (viper.GetString(pair[1]) == "") {
+			add(pair[0], "%s and %s must be set together", pair[0], pair[1])
+		}
+	}
+
+	listeners := map[string]string{}
+	for _, key := range []string{"listen-address", "admin-listen-address", "metrics-listen-address"} {
+		addr := viper.GetString(key)
+		if addr == "" {
+			continue
+		}
+
+		if other, ok := listeners[addr]; ok {
+			add(key, "%s is already used by %s", addr, other)
+			continue
+		}
+		listeners[addr] = key
+	}
+
+	if viper.GetString("admin-listen-address") != "" && viper.GetString("admin-api-token") == "" && viper.GetString("admin-api-token-file") == "" {
+		add("admin-listen-address", "requires admin-api-token or admin-api-token-file")
+	}
+
+	if viper.GetString("tls-client-ca-file") != "" && viper.GetString("tls-cert-file") == "" {
+		add("tls-client-ca-file", "requires tls-cert-file and tls-key-file")
+	}
+
+	if viper.GetBool("tls-skip-verify") && viper.GetString("grafana-ca-file") != "" {
+		add("tls-skip-verify", "conflicts with grafana-ca-file, Grafana's certificate is either verified or not")
+	}
+
+	if viper.GetDuration("grafana-retry-backoff") > viper.GetDuration("grafana-retry-max-backoff") {
+		add("grafana-retry-backoff", "is greater than grafana-retry-max-backoff")
+	}
+
+	if path := viper.GetString("denied-page-file"); path != "" {
+		if _, err := loadDeniedPage(path); err != nil {
+			add("denied-page-file", "%s", err)
+		}
+	}
+
+	if ratio := viper.GetFloat64("tracing-sample-ratio"); ratio < 0 || ratio > 1 {
+		add("tracing-sample-ratio", "must be between 0 and 1, got %v", ratio)
+	}
+
+	return problems
+}
@@ -0,0 +1,141 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrEmptyFile = errors.New("credentials file is empty")
+	ErrConflict  = errors.New("a Grafana API token can't be used with an admin password")
+)
+
+// Config are the credentials of Grafana's admin API, either a user and
+// password or a service account token. PasswordFile takes precedence over
+// Password.
+type Config struct {
+	User         string
+	Password     string
+	PasswordFile string
+	TokenFile    string
+}
+
+// Credentials authenticates the requests to Grafana's admin API with the
+// credentials in Config, the files are loaded once and can be reloaded
+// without rebuilding the client.
+type Credentials struct {
+	config Config
+
+	mu       sync.RWMutex
+	password string
+	token    string
+}
+
+// New loads the files and returns Credentials.
+func New(config Config) (*Credentials, error) {
+	if config.TokenFile != "" && (config.Password != "" || config.PasswordFile != "") {
+		return nil, ErrConflict
+	}
+
+	c := &Credentials{
+		config:   config,
+		password: config.Password,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the files again. On error the previous credentials are kept,
+// an empty file is an error as it is usually being written.
+func (c *Credentials) Reload() error {
+	var password, token string
+	if c.config.PasswordFile != "" {
+		var err error
+		password, err = readFile(c.config.PasswordFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.config.TokenFile != "" {
+		var err error
+		token, err = readFile(c.config.TokenFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config.PasswordFile != "" {
+		c.password = password
+	}
+	c.token = token
+
+	return nil
+}
+
+// Watch reloads the files every time they change until ctx is done.
+func (c *Credentials) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, []string{c.config.PasswordFile, c.config.TokenFile}, func() {
+		if err := c.Reload(); err != nil {
+			log.WithError(err).Error("error reloading Grafana credentials, keeping the previous ones")
+			return
+		}
+
+		log.Info("reloaded Grafana credentials")
+	})
+}
+
+// Transport returns a RoundTripper that authenticates every request with the
+// last loaded credentials before sending it with next.
+func (c *Credentials) Transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		c.mu.RLock()
+		password, token := c.password, c.token
+		c.mu.RUnlock()
+
+		// a RoundTripper must not modify the request
+		r = r.Clone(r.Context())
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			r.SetBasicAuth(c.config.User, password)
+		}
+
+		return next.RoundTrip(r)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func readFile(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+
+	// editors and kubectl add a trailing newline
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%w: %s", ErrEmptyFile, file)
+	}
+
+	return value, nil
+}
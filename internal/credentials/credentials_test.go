@@ -0,0 +1,93 @@
+package credentials
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// authorization returns the Authorization header Grafana receives from a
+// client using creds.
+func authorization(t *testing.T, creds *Credentials) string {
+	t.Helper()
+
+	var header string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer backend.Close()
+
+	client := &http.Client{Transport: creds.Transport(http.DefaultTransport)}
+	resp, err := client.Get(backend.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	return header
+}
+
+func TestCredentials(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("glsa_token\n"), 0600))
+
+	creds, err := New(Config{User: "admin", Password: "from-flag"})
+	assert.NoError(t, err)
+	// admin:from-flag
+	assert.Equal(t, "Basic YWRtaW46ZnJvbS1mbGFn", authorization(t, creds))
+
+	creds, err = New(Config{User: "admin", Password: "from-flag", PasswordFile: passwordFile})
+	assert.NoError(t, err)
+	// admin:from-file
+	assert.Equal(t, "Basic YWRtaW46ZnJvbS1maWxl", authorization(t, creds))
+
+	creds, err = New(Config{User: "admin", TokenFile: tokenFile})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer glsa_token", authorization(t, creds))
+
+	_, err = New(Config{User: "admin", PasswordFile: passwordFile, TokenFile: tokenFile})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	_, err = New(Config{User: "admin", TokenFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+
+	// an empty file keeps the previous credentials
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("\n"), 0600))
+	assert.ErrorIs(t, creds.Reload(), ErrEmptyFile)
+	assert.Equal(t, "Bearer glsa_token", authorization(t, creds))
+}
+
+func TestCredentialsWatch(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("first"), 0600))
+
+	creds, err := New(Config{TokenFile: tokenFile})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		assert.NoError(t, creds.Watch(ctx))
+	}()
+
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("second"), 0600))
+
+	assert.Eventually(t, func() bool {
+		creds.mu.RLock()
+		defer creds.mu.RUnlock()
+
+		return creds.token == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
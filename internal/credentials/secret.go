@@ -0,0 +1,71 @@
+package credentials
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+// Secret is a single value, like a token, either set directly or loaded from
+// a file that can be reloaded. The file takes precedence over the value.
+type Secret struct {
+	file string
+
+	mu    sync.RWMutex
+	value string
+}
+
+// NewSecret loads file, when it is set, and returns a Secret.
+func NewSecret(value, file string) (*Secret, error) {
+	s := &Secret{
+		file:  file,
+		value: value,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Value returns the last loaded value.
+func (s *Secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.value
+}
+
+// Reload reads the file again. On error the previous value is kept, an empty
+// file is an error as it is usually being written.
+func (s *Secret) Reload() error {
+	if s.file == "" {
+		return nil
+	}
+
+	value, err := readFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.value = value
+
+	return nil
+}
+
+// Watch reloads the file every time it changes until ctx is done.
+func (s *Secret) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, []string{s.file}, func() {
+		if err := s.Reload(); err != nil {
+			log.WithError(err).Errorf("error reloading %s, keeping the previous value", s.file)
+			return
+		}
+
+		log.Infof("reloaded %s", s.file)
+	})
+}
@@ -0,0 +1,58 @@
+package credentials
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecret(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0600))
+
+	secret, err := NewSecret("from-flag", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-flag", secret.Value())
+
+	secret, err = NewSecret("from-flag", tokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", secret.Value())
+
+	_, err = NewSecret("", filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	// an empty file keeps the previous value
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("\n"), 0600))
+	assert.ErrorIs(t, secret.Reload(), ErrEmptyFile)
+	assert.Equal(t, "from-file", secret.Value())
+}
+
+func TestSecretWatch(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("first"), 0600))
+
+	secret, err := NewSecret("", tokenFile)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		assert.NoError(t, secret.Watch(ctx))
+	}()
+
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("second"), 0600))
+
+	assert.Eventually(t, func() bool {
+		return secret.Value() == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,90 @@
+package filewatch
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Watch calls onChange every time one of the files changes. It watches the
+// parent directories instead of the files themselves so changes are also
+// detected when a file is replaced, either by an editor or by Kubernetes
+// swapping the symlinks of a mounted Secret or ConfigMap. Empty paths are
+// ignored. It blocks until ctx is done.
+func Watch(ctx context.Context, files []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// resolved keeps the target of each file to detect symlink swaps, which
+	// only generate events for the swapped link
+	resolved := make(map[string]string)
+	dirs := make(map[string]bool)
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		file = filepath.Clean(file)
+		resolved[file] = resolve(file)
+
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		dirs[dir] = true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			changed := false
+			for file, target := range resolved {
+				current := resolve(file)
+				if filepath.Clean(event.Name) == file || current != target {
+					resolved[file] = current
+					changed = true
+				}
+			}
+
+			if changed {
+				log.Debugf("detected change in watched files: %s", event)
+				onChange()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			log.WithError(err).Warn("error watching files")
+		}
+	}
+}
+
+func resolve(file string) string {
+	target, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return ""
+	}
+
+	return target
+}
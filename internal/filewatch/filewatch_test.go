@@ -0,0 +1,75 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startWatch(t *testing.T, files []string) <-chan struct{} {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	changes := make(chan struct{}, 10)
+	go func() {
+		assert.NoError(t, Watch(ctx, files, func() { changes <- struct{}{} }))
+	}()
+
+	// give the watcher time to register the directories
+	time.Sleep(100 * time.Millisecond)
+
+	return changes
+}
+
+func assertChanged(t *testing.T, changes <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change was not detected")
+	}
+}
+
+func TestWatchWrite(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	assert.NoError(t, os.WriteFile(file, []byte("one"), 0600))
+
+	changes := startWatch(t, []string{file, ""})
+
+	assert.NoError(t, os.WriteFile(file, []byte("two"), 0600))
+	assertChanged(t, changes)
+}
+
+// TestWatchSymlinkSwap replicates how Kubernetes updates mounted volumes:
+// the file is a symlink into ..data, which is itself a symlink that gets
+// atomically replaced.
+func TestWatchSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, version := range []string{"v1", "v2"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0700))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, version, "password"), []byte(version), 0600))
+	}
+
+	assert.NoError(t, os.Symlink("v1", filepath.Join(dir, "..data")))
+	file := filepath.Join(dir, "password")
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "password"), file))
+
+	changes := startWatch(t, []string{file})
+
+	assert.NoError(t, os.Symlink("v2", filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	assertChanged(t, changes)
+
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(content))
+}
@@ -1,6 +1,8 @@
 package jwt
 
 import (
+	"encoding/json"
+
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -10,6 +12,28 @@ type Claims struct {
 	jwt.Claims
 	Groups []string `json:"groups"`
 	Email  string   `json:"email"`
+	// Raw has every claim of the token, including the ones Claims doesn't
+	// know about.
+	Raw map[string]interface{} `json:"-"`
+}
+
+// Map returns every claim. Claims that were not read from a token only have
+// the claims it knows about.
+func (c *Claims) Map() map[string]interface{} {
+	if c.Raw != nil {
+		return c.Raw
+	}
+
+	claims := make(map[string]interface{})
+	data, err := json.Marshal(c)
+	if err != nil {
+		return claims
+	}
+
+	// the claims were just encoded, decoding them can't fail
+	_ = json.Unmarshal(data, &claims)
+
+	return claims
 }
 
 // TokenClaims returns Claims from a jwt token in raw base64 format
@@ -20,8 +44,8 @@ func TokenClaims(rawToken string) (*Claims, error) {
 		return nil, err
 	}
 
-	out := &Claims{}
-	if err := token.UnsafeClaimsWithoutVerification(out); err != nil {
+	out := &Claims{Raw: make(map[string]interface{})}
+	if err := token.UnsafeClaimsWithoutVerification(out, &out.Raw); err != nil {
 		log.Error("Error when getting Claims from token, ", err)
 		return nil, err
 	}
@@ -12,7 +12,13 @@ func NewTestJWTWithClaims(claims Claims) (string, error) {
 		return "", err
 	}
 
-	raw, err := josejwt.Signed(sig).Claims(claims).CompactSerialize()
+	// Raw adds claims that Claims doesn't know about
+	builder := josejwt.Signed(sig).Claims(claims)
+	if claims.Raw != nil {
+		builder = builder.Claims(claims.Raw)
+	}
+
+	raw, err := builder.CompactSerialize()
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+var errAdminUnauthorized = errors.New("missing or wrong admin API token")
+
+// adminUser is the sync state of a user as shown by the admin API.
+type adminUser struct {
+	Login    string                     `json:"login"`
+	UserID   int64                      `json:"userId"`
+	Email    string                     `json:"email"`
+	Groups   []string                   `json:"groups"`
+	OrgRoles map[int64]grafana.RoleType `json:"orgRoles"`
+	SyncedAt time.Time                  `json:"syncedAt"`
+}
+
+func newAdminUser(login string, state userSyncState) adminUser {
+	user := adminUser{
+		Login:    login,
+		UserID:   state.User.ID,
+		Email:    state.User.Email,
+		Groups:   []string{},
+		OrgRoles: state.OrgRoles,
+		SyncedAt: state.SyncedAt,
+	}
+
+	if state.Claims != nil && state.Claims.Groups != nil {
+		user.Groups = state.Claims.Groups
+	}
+
+	return user
+}
+
+// AdminHandler returns the handler of the admin API, which requires the value
+// returned by token as a bearer token, so it can be rotated. It is meant to be
+// served on a separate listener that is not exposed with the proxy.
+//
+//	GET    /groups               group mappings currently in use
+//	GET    /rules                rules currently in use
+//	POST   /reload               reload the group mappings and rules from the config
+//	GET    /users                users synced since the proxy started
+//	GET    /users/{login}        sync state of a user
+//	DELETE /users/{login}        forget the sync state of a user
+//	POST   /users/{login}/resync sync a user again with its last claims
+//	GET    /denylist             denied tokens
+//	PUT    /denylist/{jti}       deny a token in this replica, optionally until {"expiresAt": ...}
+//	DELETE /denylist/{jti}       allow a token denied in this replica again
+//
+// The users and the tokens denied from the admin API are kept in memory by
+// each replica and lost on restart, tokens denied for every replica go in the
+// denylist file, see SetSharedDenylist.
+func (s *Server) AdminHandler(token func() string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /groups", s.handleAdminGroups())
+	mux.HandleFunc("GET /rules", s.handleAdminRules())
+	mux.HandleFunc("POST /reload", s.handleAdminReload())
+	mux.HandleFunc("GET /users", s.handleAdminUsers())
+	mux.HandleFunc("GET /users/{login}", s.handleAdminUser())
+	mux.HandleFunc("DELETE /users/{login}", s.handleAdminEvictUser())
+	mux.HandleFunc("POST /users/{login}/resync", s.handleAdminResyncUser())
+	mux.HandleFunc("GET /denylist", s.handleAdminDenylist())
+	mux.HandleFunc("PUT /denylist/{jti}", s.handleAdminDenyToken())
+	mux.HandleFunc("DELETE /denylist/{jti}", s.handleAdminAllowToken())
+
+	return withRequestID(requireBearerToken(token, mux))
+}
+
+// requireBearerToken only lets through requests with the current token in
+// the Authorization header. An empty token rejects every request.
+func requireBearerToken(token func() string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := token()
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			logAndError(r.Context(), w, http.StatusUnauthorized, errAdminUnauthorized, "admin API request denied")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminGroups() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, s.Groups())
+	}
+}
+
+func (s *Server) handleAdminRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := s.Authz().Rules
+		if rules == nil {
+			rules = config.Rules{}
+		}
+
+		writeJSON(w, r, http.StatusOK, rules)
+	}
+}
+
+func (s *Server) handleAdminReload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.configReloader == nil {
+			logAndError(r.Context(), w, http.StatusNotImplemented, nil, "config reload is not configured")
+			return
+		}
+
+		if err := s.configReloader(); err != nil {
+			logAndError(r.Context(), w, http.StatusUnprocessableEntity, err, "error reloading config")
+			return
+		}
+
+		logging.FromContext(r.Context()).Info("config reloaded from the admin API")
+		writeJSON(w, r, http.StatusOK, s.Groups())
+	}
+}
+
+func (s *Server) handleAdminUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		states := s.syncCache.list()
+
+		users := make([]adminUser, 0, len(states))
+		for login, state := range states {
+			users = append(users, newAdminUser(login, state))
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+
+		writeJSON(w, r, http.StatusOK, users)
+	}
+}
+
+func (s *Server) handleAdminUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := r.PathValue("login")
+
+		state, ok := s.syncCache.get(login)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, newAdminUser(login, state))
+	}
+}
+
+func (s *Server) handleAdminEvictUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := r.PathValue("login")
+
+		if !s.syncCache.delete(login) {
+			http.NotFound(w, r)
+			return
+		}
+
+		logging.FromContext(r.Context()).WithField("login", login).Info("user sync state evicted from the admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleAdminResyncUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := r.PathValue("login")
+		ctx := logging.NewContext(r.Context(), log.Fields{"login": login})
+
+		// the claims of the last login are needed to resolve the groups
+		state, ok := s.syncCache.get(login)
+		if !ok || state.Claims == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		state, err := s.coalescedSyncUser(ctx, login, state.Claims)
+		if err != nil {
+			code := http.StatusBadGateway
+			if grafana.IsUnavailable(err) {
+				w.Header().Set("Retry-After", retryAfter(err))
+				code = http.StatusServiceUnavailable
+			}
+
+			logAndError(ctx, w, code, err, "error syncing user with Grafana")
+			return
+		}
+
+		logging.FromContext(ctx).Info("user synced from the admin API")
+		writeJSON(w, r, http.StatusOK, newAdminUser(login, state))
+	}
+}
+
+func (s *Server) handleAdminDenylist() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, s.denylist.list())
+	}
+}
+
+func (s *Server) handleAdminDenyToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := DeniedToken{ID: r.PathValue("jti")}
+
+		// the body is optional, without it the token is denied until removed
+		var body struct {
+			ExpiresAt *time.Time `json:"expiresAt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			logAndError(r.Context(), w, http.StatusBadRequest, err, "error reading denied token")
+			return
+		}
+		token.ExpiresAt = body.ExpiresAt
+
+		s.denylist.add(token)
+
+		logging.FromContext(r.Context()).WithField("jti", token.ID).Info("token denied from the admin API")
+		writeJSON(w, r, http.StatusOK, token)
+	}
+}
+
+func (s *Server) handleAdminAllowToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("jti")
+
+		if !s.denylist.remove(id) {
+			if s.denylist.isShared(id) {
+				logAndError(r.Context(), w, http.StatusConflict, nil, "token is denied by the denylist file")
+				return
+			}
+
+			http.NotFound(w, r)
+			return
+		}
+
+		logging.FromContext(r.Context()).WithField("jti", id).Info("token removed from the denylist from the admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		logAndError(r.Context(), w, http.StatusInternalServerError, err, "error encoding response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, string(bytes))
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	reloads := 0
+	reloadErr := error(nil)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Viewer"}}}}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+		WithConfigReloader(func() error {
+			reloads++
+			return reloadErr
+		}),
+	)
+	assert.NoError(t, err)
+
+	adminToken := "secret"
+	admin := server.AdminHandler(func() string { return adminToken })
+
+	adminRequest := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	claims := jwt.Claims{Groups: []string{"foo"}}
+	claims.Subject = "jhon"
+	claims.ID = "token-1"
+	token, err := jwt.NewTestJWTWithClaims(claims)
+	assert.NoError(t, err)
+
+	login := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the token is required
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "Basic secret"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/groups", nil)
+		req.Header.Set("Authorization", header)
+		admin.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+
+	// the admin API is not served by the proxy listener
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest("GET", "/groups", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"foo":{"orgs":[{"id":1,"role":"Viewer"}]}}`, w.Body.String())
+
+	// a rotated token is required from the next request
+	adminToken = "rotated"
+	w = adminRequest("GET", "/groups", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	adminToken = "secret"
+
+	w = adminRequest("GET", "/rules", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	// users
+	w = adminRequest("GET", "/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	assert.Equal(t, http.StatusOK, login())
+
+	w = adminRequest("GET", "/users/jhon", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"login":"jhon","userId":1`)
+	assert.Contains(t, w.Body.String(), `"groups":["foo"],"orgRoles":{"1":"Viewer"}`)
+
+	server.SetGroups(config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Editor"}}}})
+	assert.Equal(t, http.StatusNotFound, adminRequest("POST", "/users/jhon/resync", "").Code)
+
+	assert.Equal(t, http.StatusOK, login())
+	w = adminRequest("POST", "/users/jhon/resync", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"orgRoles":{"1":"Editor"}`)
+
+	w = adminRequest("GET", "/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `[{"login":"jhon"`)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest("DELETE", "/users/jhon", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest("DELETE", "/users/jhon", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest("GET", "/users/jhon", "").Code)
+
+	// denylist
+	assert.Equal(t, http.StatusOK, adminRequest("PUT", "/denylist/token-1", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, login())
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w = adminRequest("PUT", "/denylist/token-2", fmt.Sprintf(`{"expiresAt":%q}`, expiresAt))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"jti":"token-2","expiresAt":%q}`, expiresAt), w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest("PUT", "/denylist/token-3", `{"expiresAt":"tomorrow"}`).Code)
+
+	w = adminRequest("GET", "/denylist", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`[{"jti":"token-1"},{"jti":"token-2","expiresAt":%q}]`, expiresAt), w.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, adminRequest("DELETE", "/denylist/token-1", "").Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest("DELETE", "/denylist/token-1", "").Code)
+	assert.Equal(t, http.StatusOK, login())
+
+	// tokens of the denylist file can't be allowed from the admin API
+	server.SetSharedDenylist([]DeniedToken{{ID: "token-1"}})
+	assert.Equal(t, http.StatusUnauthorized, login())
+	assert.Equal(t, http.StatusConflict, adminRequest("DELETE", "/denylist/token-1", "").Code)
+	server.SetSharedDenylist(nil)
+	assert.Equal(t, http.StatusOK, login())
+
+	// reload
+	assert.Equal(t, http.StatusOK, adminRequest("POST", "/reload", "").Code)
+	reloadErr = errors.New("invalid config")
+	assert.Equal(t, http.StatusUnprocessableEntity, adminRequest("POST", "/reload", "").Code)
+	assert.Equal(t, 2, reloads)
+}
+
+func TestDenylistExpiry(t *testing.T) {
+	d := newDenylist()
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	d.add(DeniedToken{ID: "expired", ExpiresAt: &past})
+	d.add(DeniedToken{ID: "denied", ExpiresAt: &future})
+	d.add(DeniedToken{ID: "forever"})
+
+	assert.False(t, d.contains("expired"))
+	assert.True(t, d.contains("denied"))
+	assert.True(t, d.contains("forever"))
+	assert.False(t, d.contains("unknown"))
+
+	assert.Equal(t, []DeniedToken{{ID: "denied", ExpiresAt: &future}, {ID: "forever"}}, d.list())
+	// expired tokens are forgotten
+	assert.False(t, d.remove("expired"))
+}
+
+func TestDenylistShared(t *testing.T) {
+	d := newDenylist()
+
+	past := time.Now().Add(-time.Second)
+
+	d.add(DeniedToken{ID: "both"})
+	d.add(DeniedToken{ID: "local"})
+	d.setShared([]DeniedToken{{ID: "both"}, {ID: "shared"}, {ID: "expired", ExpiresAt: &past}})
+
+	assert.True(t, d.contains("both"))
+	assert.True(t, d.contains("local"))
+	assert.True(t, d.contains("shared"))
+	assert.False(t, d.contains("expired"))
+
+	assert.Equal(t, []DeniedToken{{ID: "both", Shared: true}, {ID: "local"}, {ID: "shared", Shared: true}}, d.list())
+
+	assert.False(t, d.remove("shared"))
+	assert.True(t, d.isShared("shared"))
+
+	// a reload replaces the shared tokens only
+	d.setShared(nil)
+	assert.True(t, d.contains("both"))
+	assert.False(t, d.contains("shared"))
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+)
+
+// defaultDeniedPage is served to the users the config doesn't allow to log
+// in, unless another page is set with WithDeniedPage.
+var defaultDeniedPage = template.Must(template.New("denied").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Access denied</title>
+</head>
+<body>
+<h1>Access denied</h1>
+<p>{{if .Login}}{{.Login}}, you{{else}}You{{end}} are not allowed to access Grafana.</p>
+<p>Contact your administrator if you think this is a mistake{{if .RequestID}} and give them the request ID {{.RequestID}}{{end}}.</p>
+</body>
+</html>
+`))
+
+// deniedError is returned by the sync of a user the config doesn't allow to
+// log in.
+type deniedError struct {
+	// reason is one of the config.DENIED_BY constants
+	reason string
+	denial string
+}
+
+func (e *deniedError) Error() string {
+	return "login denied, " + e.denial
+}
+
+// deniedPageData is the data of the denied page template.
+type deniedPageData struct {
+	Login     string
+	Reason    string
+	RequestID string
+}
+
+// ValidateDeniedPage renders page once, to catch the fields that don't exist
+// before a user is denied.
+func ValidateDeniedPage(page *template.Template) error {
+	if err := page.Execute(io.Discard, deniedPageData{}); err != nil {
+		return fmt.Errorf("invalid denied page: %w", err)
+	}
+
+	return nil
+}
+
+// denyPage answers a request of a user the config doesn't allow to log in
+// with a 403 and the denied page, and records the reason in the metrics and
+// the audit log.
+func (s *Server) denyPage(ctx context.Context, w http.ResponseWriter, r *http.Request, login string, err *deniedError) {
+	s.metrics.authFailure(err.reason)
+	s.audit.Log(ctx, audit.Event{Event: audit.EVENT_LOGIN_DENIED, Reason: err.reason})
+
+	logger := logging.FromContext(ctx)
+	logger.WithError(err).Warn("user is not allowed to log in")
+
+	page := s.deniedPage
+	if page == nil {
+		page = defaultDeniedPage
+	}
+
+	// rendered first so a broken template still gets a proper status
+	var body bytes.Buffer
+	data := deniedPageData{Login: login, Reason: err.reason, RequestID: r.Header.Get(requestIDHeader)}
+	if err := page.Execute(&body, data); err != nil {
+		logger.WithError(err).Error("error rendering the denied page")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write(body.Bytes())
+}
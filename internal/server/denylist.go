@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errTokenDenied = errors.New("token is denied")
+
+// DeniedToken is a token rejected by the proxy even though it is valid.
+// ExpiresAt is nil when the token is denied until it is removed from the
+// denylist.
+type DeniedToken struct {
+	ID        string     `json:"jti"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Shared is set on the tokens of the denylist file, which every replica
+	// reads, instead of the admin API of one replica.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// denylist holds the IDs of the denied tokens, from their jti claim. Tokens
+// are forgotten once they expire, as they would be rejected anyway. The
+// tokens denied from the admin API only live in this replica, the shared
+// ones are replaced every time the denylist file is loaded.
+type denylist struct {
+	mu     sync.RWMutex
+	tokens map[string]DeniedToken
+	shared map[string]DeniedToken
+}
+
+func newDenylist() *denylist {
+	return &denylist{
+		tokens: make(map[string]DeniedToken),
+		shared: make(map[string]DeniedToken),
+	}
+}
+
+// setShared replaces the shared tokens.
+func (d *denylist) setShared(tokens []DeniedToken) {
+	shared := make(map[string]DeniedToken, len(tokens))
+	for _, token := range tokens {
+		token.Shared = true
+		shared[token.ID] = token
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.shared = shared
+}
+
+// isShared reports whether id is denied by the denylist file.
+func (d *denylist) isShared(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	token, ok := d.shared[id]
+	return ok && !isExpired(token, time.Now())
+}
+
+func (d *denylist) add(token DeniedToken) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tokens[token.ID] = token
+}
+
+// remove reports whether id was denied from the admin API, shared tokens
+// can only be removed from the denylist file.
+func (d *denylist) remove(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.tokens[id]
+	delete(d.tokens, id)
+
+	return ok
+}
+
+func (d *denylist) contains(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	if token, ok := d.tokens[id]; ok && !isExpired(token, now) {
+		return true
+	}
+
+	token, ok := d.shared[id]
+	return ok && !isExpired(token, now)
+}
+
+// list returns the denied tokens sorted by ID, and forgets the expired ones
+// denied from the admin API. A token that is also shared is listed once, as
+// shared.
+func (d *denylist) list() []DeniedToken {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	tokens := make([]DeniedToken, 0, len(d.tokens))
+	for id, token := range d.tokens {
+		if isExpired(token, now) {
+			delete(d.tokens, id)
+			continue
+		}
+
+		if _, ok := d.shared[id]; !ok {
+			tokens = append(tokens, token)
+		}
+	}
+
+	for _, token := range d.shared {
+		if !isExpired(token, now) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	return tokens
+}
+
+func isExpired(token DeniedToken, now time.Time) bool {
+	return token.ExpiresAt != nil && !now.Before(*token.ExpiresAt)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for an authentication failure
+const (
+	reasonMissingCookie      = "missing_cookie"
+	reasonMissingHeader      = "missing_header"
+	reasonInvalidToken       = "invalid_token"
+	reasonEmptySub           = "empty_sub"
+	reasonTokenDenied        = "token_denied"
+	reasonIdentityMismatch   = "identity_mismatch"
+	reasonGrafanaError       = "grafana_error"
+	reasonGrafanaUnavailable = "grafana_unavailable"
+)
+
+type metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	authFailures    *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grafana_auth_proxy_http_requests_total",
+			Help: "Requests handled by the proxy by status code and method.",
+		}, []string{"code", "method"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grafana_auth_proxy_http_request_duration_seconds",
+			Help:    "Latency of the requests handled by the proxy by status code and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code", "method"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grafana_auth_proxy_authentication_failures_total",
+			Help: "Requests that failed authentication by reason.",
+		}, []string{"reason"}),
+	}
+}
+
+func (m *metrics) register(reg prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{m.requests, m.requestDuration, m.authFailures} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// instrument records the count and latency of the requests served by next.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(m.requests,
+		promhttp.InstrumentHandlerDuration(m.requestDuration, next))
+}
+
+// authFailure records an authentication failure.
+func (m *metrics) authFailure(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+// MetricsHandler returns the handler of the metrics gathered by the registry
+// of WithMetricsRegistry. It is meant to be served on a separate listener, so
+// the proxy never hides Grafana's own /metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	if s.metricsRegistry == nil {
+		return http.NotFoundHandler()
+	}
+
+	return promhttp.HandlerFor(s.metricsRegistry, promhttp.HandlerOpts{})
+}
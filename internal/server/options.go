@@ -1,10 +1,14 @@
 package server
 
 import (
+	"crypto/tls"
+	"html/template"
 	"net/url"
 
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func WithCookieName(cookie string) ServerFuncOpt {
@@ -21,9 +25,15 @@ func WithHeaderName(header string) ServerFuncOpt {
 	}
 }
 
+// WithConfigGroups sets the group mappings, without rules.
 func WithConfigGroups(groups config.Groups) ServerFuncOpt {
+	return WithConfigAuthz(config.Authz{Groups: groups})
+}
+
+// WithConfigAuthz sets the group mappings and the rules.
+func WithConfigAuthz(authz config.Authz) ServerFuncOpt {
 	return func(s *Server) error {
-		s.groups = groups
+		s.authz.Store(&authz)
 		return nil
 	}
 }
@@ -49,6 +59,39 @@ func SkipTLSVerify() ServerFuncOpt {
 	}
 }
 
+// WithUpstreamTLSConfig sets the TLS configuration of the connections to
+// Grafana, it takes precedence over SkipTLSVerify.
+func WithUpstreamTLSConfig(config *tls.Config) ServerFuncOpt {
+	return func(s *Server) error {
+		s.upstreamTLSConfig = config
+		return nil
+	}
+}
+
+func WithTransportConfig(config TransportConfig) ServerFuncOpt {
+	return func(s *Server) error {
+		s.transportConfig = config
+		return nil
+	}
+}
+
+// WithMetricsRegistry registers the proxy metrics in registry, everything it
+// gathers is served by MetricsHandler.
+func WithMetricsRegistry(registry *prometheus.Registry) ServerFuncOpt {
+	return func(s *Server) error {
+		s.metricsRegistry = registry
+		return nil
+	}
+}
+
+// WithAuditLogger records authentication decisions in logger.
+func WithAuditLogger(logger *audit.Logger) ServerFuncOpt {
+	return func(s *Server) error {
+		s.audit = logger
+		return nil
+	}
+}
+
 func WithGrafanaResponseHeaders(headers GrafanaResponseHeaders) ServerFuncOpt {
 	return func(s *Server) error {
 		s.grafanaResponseHeaders = headers
@@ -62,3 +105,28 @@ func WithGrafanaClaimsConfig(config GrafanaClaimsConfig) ServerFuncOpt {
 		return nil
 	}
 }
+
+// WithConfigReloader sets the function the admin API calls to reload the
+// group mappings and rules from the config.
+func WithConfigReloader(reload func() error) ServerFuncOpt {
+	return func(s *Server) error {
+		s.configReloader = reload
+		return nil
+	}
+}
+
+// WithDeniedPage sets the HTML page served with a 403 to the users the config
+// doesn't allow to log in. The template gets the Login, the Reason and the
+// RequestID of the request.
+func WithDeniedPage(page *template.Template) ServerFuncOpt {
+	return func(s *Server) error {
+		if page != nil {
+			if err := ValidateDeniedPage(page); err != nil {
+				return err
+			}
+		}
+
+		s.deniedPage = page
+		return nil
+	}
+}
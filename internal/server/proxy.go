@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// TransportConfig tunes the connections of the reverse proxy to Grafana. Zero
+// values keep the defaults of http.DefaultTransport.
+type TransportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	KeepAlive             time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableHTTP2          bool
+}
+
+// newTransport returns the transport shared by every proxied request.
+func (s *Server) newTransport() *http.Transport {
+	cfg := s.transportConfig
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.KeepAlive != 0 {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: cfg.KeepAlive,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	if cfg.MaxIdleConns != 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+
+	// every request goes to the same host, so this is the limit that
+	// matters for connection reuse
+	if cfg.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+
+	if cfg.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+
+	if cfg.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	switch {
+	case s.upstreamTLSConfig != nil:
+		transport.TLSClientConfig = s.upstreamTLSConfig
+	case s.skipTLSVerify:
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return transport
+}
+
+// newReverseProxy returns the reverse proxy to Grafana, it is built once and
+// reused by every request so connections are pooled. Upstream requests are
+// traced and carry the W3C trace context to Grafana.
+func (s *Server) newReverseProxy() *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(s.grafanaProxyUrl)
+	proxy.Transport = otelhttp.NewTransport(s.newTransport())
+
+	return proxy
+}
+
+// upgrades tracks the connections the proxy upgraded, like the websockets of
+// Grafana Live. http.Server.Shutdown doesn't wait for them as they are
+// hijacked from the server.
+type upgrades struct {
+	wg      sync.WaitGroup
+	closing context.Context
+	close   context.CancelFunc
+}
+
+func newUpgrades() *upgrades {
+	u := &upgrades{}
+	u.closing, u.close = context.WithCancel(context.Background())
+
+	return u
+}
+
+// track returns a context for an upgraded request that is cancelled, which
+// closes the upgraded connection, when the upgrades are closed. done must be
+// called when the request ends.
+func (u *upgrades) track(ctx context.Context) (context.Context, func()) {
+	u.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(u.closing, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+		u.wg.Done()
+	}
+}
+
+// isUpgrade reports whether r asks to upgrade the connection to another
+// protocol, like a websocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WaitUpgraded waits for the connections upgraded by the proxy, like Grafana
+// Live websockets, to end after the server is shut down. The ones still open
+// when ctx is done are closed.
+func (s *Server) WaitUpgraded(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.upgrades.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.upgrades.close()
+	<-done
+
+	return ctx.Err()
+}
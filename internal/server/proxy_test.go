@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	s := &Server{}
+	transport := s.newTransport()
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.False(t, transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify)
+
+	s = &Server{
+		skipTLSVerify: true,
+		transportConfig: TransportConfig{
+			MaxIdleConns:          10,
+			MaxIdleConnsPerHost:   5,
+			IdleConnTimeout:       time.Minute,
+			KeepAlive:             time.Second,
+			ResponseHeaderTimeout: 2 * time.Second,
+			DisableHTTP2:          true,
+		},
+	}
+	transport = s.newTransport()
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, 2*time.Second, transport.ResponseHeaderTimeout)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+}
+
+// BenchmarkReverseProxy compares building a proxy and a transport per request,
+// which pays a new TLS handshake every time, with the shared proxy.
+func BenchmarkReverseProxy(b *testing.B) {
+	backendServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	s := &Server{grafanaProxyUrl: backendURL, skipTLSVerify: true}
+
+	b.Run("per-request", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			proxy := httputil.NewSingleHostReverseProxy(backendURL)
+			transport := &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			}
+			proxy.Transport = transport
+
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			// the previous implementation leaked these, close them so the
+			// benchmark doesn't run out of file descriptors
+			transport.CloseIdleConnections()
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		proxy := s.newReverseProxy()
+
+		for i := 0; i < b.N; i++ {
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+	})
+}
+
+func TestWaitUpgraded(t *testing.T) {
+	// an echo server standing in for Grafana Live
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	frontend := httptest.NewServer(server)
+	defer frontend.Close()
+
+	upgrade := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		fmt.Fprintf(conn, "GET /api/live/ws HTTP/1.1\r\nHost: grafana\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: auth_token=%s\r\n\r\n", newTestJWTToken("jhon"))
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+		return conn, reader
+	}
+
+	echo := func(conn net.Conn, reader *bufio.Reader) error {
+		if _, err := fmt.Fprint(conn, "ping\n"); err != nil {
+			return err
+		}
+
+		line, err := reader.ReadString('\n')
+		if err == nil && line != "ping\n" {
+			err = fmt.Errorf("unexpected echo %q", line)
+		}
+		return err
+	}
+
+	conn, reader := upgrade()
+	assert.NoError(t, echo(conn, reader))
+
+	// the upgraded connection outlives Shutdown and keeps working
+	assert.NoError(t, frontend.Config.Shutdown(context.Background()))
+
+	waited := make(chan error, 1)
+	go func() { waited <- server.WaitUpgraded(context.Background()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-waited:
+		t.Fatal("WaitUpgraded returned with an open upgraded connection")
+	default:
+	}
+	assert.NoError(t, echo(conn, reader))
+
+	conn.Close()
+	select {
+	case err := <-waited:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitUpgraded didn't return after the connection was closed")
+	}
+}
+
+func TestWaitUpgradedGracePeriod(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		_, _ = io.Copy(io.Discard, rw)
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	frontend := httptest.NewServer(server)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /api/live/ws HTTP/1.1\r\nHost: grafana\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: auth_token=%s\r\n\r\n", newTestJWTToken("jhon"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	assert.NoError(t, frontend.Config.Shutdown(context.Background()))
+
+	// the connections still open at the end of the grace period are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.WaitUpgraded(ctx), context.DeadlineExceeded)
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	checkStatusOK       = "ok"
+	checkStatusError    = "error"
+	checkStatusPending  = "pending"
+	checkStatusDegraded = "degraded"
+)
+
+// readinessCheckTimeout bounds a single run of the readiness checks.
+const readinessCheckTimeout = 5 * time.Second
+
+type readinessCheck struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                    `json:"status"`
+	Checks map[string]readinessCheck `json:"checks,omitempty"`
+}
+
+// readinessFunc is a readiness check. When degraded is set and reports true
+// for the error of a failed run, the check is degraded instead of failed and
+// doesn't make the server unready.
+type readinessFunc struct {
+	check    func(context.Context) error
+	degraded func(error) bool
+}
+
+// readiness keeps the result of the last run of each readiness check, the
+// checks run in the background so probes never wait on Grafana.
+type readiness struct {
+	mu     sync.RWMutex
+	checks map[string]readinessCheck
+	funcs  map[string]readinessFunc
+}
+
+func newReadiness() *readiness {
+	return &readiness{
+		checks: make(map[string]readinessCheck),
+		funcs:  make(map[string]readinessFunc),
+	}
+}
+
+// register adds a check that is reported as pending until it runs. degraded
+// can be nil.
+func (r *readiness) register(name string, check func(context.Context) error, degraded func(error) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.funcs[name] = readinessFunc{check: check, degraded: degraded}
+	r.checks[name] = readinessCheck{Status: checkStatusPending}
+}
+
+// run executes every check once and records the results.
+func (r *readiness) run(ctx context.Context) {
+	r.mu.RLock()
+	funcs := make(map[string]readinessFunc, len(r.funcs))
+	for name, f := range r.funcs {
+		funcs[name] = f
+	}
+	r.mu.RUnlock()
+
+	for name, f := range funcs {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		err := f.check(checkCtx)
+		cancel()
+
+		now := time.Now()
+		result := readinessCheck{Status: checkStatusOK, CheckedAt: &now}
+		switch {
+		case err == nil:
+		case f.degraded != nil && f.degraded(err):
+			log.WithError(err).Warnf("readiness check %s failed, serving degraded", name)
+			result.Status = checkStatusDegraded
+			result.Error = err.Error()
+		default:
+			log.WithError(err).Warnf("readiness check %s failed", name)
+			result.Status = checkStatusError
+			result.Error = err.Error()
+		}
+
+		r.mu.Lock()
+		r.checks[name] = result
+		r.mu.Unlock()
+	}
+}
+
+// status returns the result of every check, whether all of them passed or
+// are degraded, and whether any of them is degraded.
+func (r *readiness) status() (_ map[string]readinessCheck, ready bool, degraded bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ready = true
+	checks := make(map[string]readinessCheck, len(r.checks))
+	for name, check := range r.checks {
+		checks[name] = check
+		ready = ready && (check.Status == checkStatusOK || check.Status == checkStatusDegraded)
+		degraded = degraded || check.Status == checkStatusDegraded
+	}
+
+	return checks, ready, degraded
+}
+
+// RunReadinessChecks verifies every interval that Grafana is reachable and
+// that the admin credentials work, until ctx is done.
+func (s *Server) RunReadinessChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.readiness.run(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
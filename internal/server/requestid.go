@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRequestIDLength bounds the request IDs accepted from clients so they
+// can't flood the logs.
+const maxRequestIDLength = 128
+
+// withRequestID makes sure every request has an X-Request-ID, keeping the one
+// set by the ingress when valid. The ID is forwarded to Grafana, returned to
+// the client and attached with the path to every log line of the request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := logging.NewContext(r.Context(), log.Fields{
+			"request_id": id,
+			"path":       r.URL.Path,
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
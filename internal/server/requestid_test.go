@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	forwarded := make(chan string, 1)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Request-ID")
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "propagated", incoming: "ingress-request-1", keep: true},
+		{name: "missing"},
+		{name: "not printable", incoming: "id\twith\ttabs"},
+		{name: "too long", incoming: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	for _, test := range tests {
+		hook.Reset()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/d/dashboard", nil)
+		if test.incoming != "" {
+			req.Header.Set("X-Request-ID", test.incoming)
+		}
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: newTestJWTToken("jhon")})
+		server.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, test.name)
+
+		id := w.Header().Get("X-Request-ID")
+		if test.keep {
+			assert.Equal(t, test.incoming, id, test.name)
+		} else {
+			assert.Len(t, id, 32, test.name)
+		}
+		assert.Equal(t, id, <-forwarded, test.name)
+
+		// every log line of the request can be correlated
+		assert.NotEmpty(t, hook.AllEntries(), test.name)
+		for _, entry := range hook.AllEntries() {
+			assert.Subset(t, entry.Data, log.Fields{"request_id": id, "path": "/d/dashboard", "login": "jhon"}, entry.Message)
+		}
+	}
+}
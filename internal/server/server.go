@@ -1,19 +1,32 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
 	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/singleflight"
 )
 
+// requestIDHeader identifies a request across the ingress, the proxy and
+// Grafana.
+const requestIDHeader = "X-Request-ID"
+
 type GrafanaResponseHeaders struct {
 	User string
 }
@@ -23,22 +36,48 @@ type GrafanaClaimsConfig struct {
 	Name  string
 }
 
+// Identity returns the login, name and email of the Grafana user of claims.
+func (c GrafanaClaimsConfig) Identity(claims *jwt.Claims) (login, name, email string) {
+	return getValidClaim(claims, c.Login), getValidClaim(claims, c.Name), claims.Email
+}
+
 type Server struct {
 	router                 *http.ServeMux
 	cookieName             string
 	headerName             string
-	groups                 config.Groups
+	authz                  atomic.Pointer[config.Authz]
 	grafanaProxyUrl        *url.URL
 	grafanaClient          *grafana.Client
 	grafanaResponseHeaders GrafanaResponseHeaders
 	grafanaClaimsConfig    GrafanaClaimsConfig
 	skipTLSVerify          bool
+	upstreamTLSConfig      *tls.Config
+	transportConfig        TransportConfig
+	proxy                  *httputil.ReverseProxy
+	syncCache              *syncCache
+	syncGroup              singleflight.Group
+	draining               atomic.Bool
+	upgrades               *upgrades
+	readiness              *readiness
+	metrics                *metrics
+	metricsRegistry        *prometheus.Registry
+	audit                  *audit.Logger
+	denylist               *denylist
+	configReloader         func() error
+	deniedPage             *template.Template
 }
 
 type ServerFuncOpt func(*Server) error
 
-func New(opts ...ServerFuncOpt) (http.Handler, error) {
-	s := &Server{router: http.NewServeMux()}
+func New(opts ...ServerFuncOpt) (*Server, error) {
+	s := &Server{
+		router:    http.NewServeMux(),
+		syncCache: newSyncCache(),
+		readiness: newReadiness(),
+		metrics:   newMetrics(),
+		denylist:  newDenylist(),
+		upgrades:  newUpgrades(),
+	}
 
 	// load options
 	for _, opt := range opts {
@@ -48,10 +87,77 @@ func New(opts ...ServerFuncOpt) (http.Handler, error) {
 		}
 	}
 
+	if s.grafanaProxyUrl != nil {
+		s.proxy = s.newReverseProxy()
+	}
+
+	if s.grafanaClient != nil {
+		s.readiness.register("grafana_health", s.grafanaClient.Health, nil)
+		// the users already synced are proxied with their cached roles while
+		// the admin API is unavailable, the server stays ready if there are any
+		s.readiness.register("grafana_admin_api", s.grafanaClient.CheckAdminAccess, func(err error) bool {
+			return grafana.IsUnavailable(err) && s.syncCache.len() > 0
+		})
+	}
+
+	if s.metricsRegistry != nil {
+		if err := s.metrics.register(s.metricsRegistry); err != nil {
+			return nil, err
+		}
+	}
+
 	s.router.HandleFunc("/healthz", s.handleHealthz())
-	s.router.HandleFunc("/", s.handleRoot())
+	s.router.HandleFunc("/readyz", s.handleReadyz())
+	s.router.Handle("/", otelhttp.NewHandler(withRequestID(s.metrics.instrument(s.handleRoot())), "proxy"))
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Authz returns the group mappings and rules currently in use.
+func (s *Server) Authz() config.Authz {
+	authz := s.authz.Load()
+	if authz == nil {
+		return config.Authz{Groups: config.Groups{}}
+	}
+
+	return *authz
+}
+
+// Groups returns the group mappings currently in use.
+func (s *Server) Groups() config.Groups {
+	return s.Authz().Groups
+}
+
+// SetAuthz replaces the group mappings and rules used by new logins. The
+// sync cache is cleared as the roles it holds were resolved from the
+// previous ones, and so are the results of the syncs still in flight.
+func (s *Server) SetAuthz(authz config.Authz) {
+	s.authz.Store(&authz)
+	s.syncCache.clear()
+}
 
-	return s.router, nil
+// SetSharedDenylist replaces the tokens denied by the denylist file, which is
+// shared by every replica unlike the tokens denied from the admin API.
+func (s *Server) SetSharedDenylist(tokens []DeniedToken) {
+	s.denylist.setShared(tokens)
+}
+
+// SetGroups replaces the group mappings used by new logins, keeping the
+// rules.
+func (s *Server) SetGroups(groups config.Groups) {
+	authz := s.Authz()
+	authz.Groups = groups
+	s.SetAuthz(authz)
+}
+
+// Drain makes the readiness check fail so no new traffic is routed to the
+// server while it shuts down.
+func (s *Server) Drain() {
+	s.draining.Store(true)
 }
 
 func getValidClaim(claims *jwt.Claims, input string) string {
@@ -66,93 +172,142 @@ func getValidClaim(claims *jwt.Claims, input string) string {
 
 func (s *Server) handleRoot() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get token
-		var token string
-
-		if s.headerName != "" {
-			token = r.Header.Get(s.headerName)
-			// replicate the cookie look up behavior for a missing header
-			if token == "" {
-				logAndError(w, http.StatusUnauthorized, fmt.Errorf("No value for header %s", s.headerName), "error reading header")
-				return
-			}
-		} else {
-			cookie, err := r.Cookie(s.cookieName)
-			if err != nil {
-				logAndError(w, http.StatusUnauthorized, err, "error reading cookie")
-				return
-			}
-			token = cookie.Value
+		ctx := audit.NewContext(r.Context(), audit.Request{RequestID: r.Header.Get(requestIDHeader)})
+
+		ctx, span := tracer.Start(ctx, "extract token")
+		token, reason, err := s.requestToken(r)
+		endSpan(span, err)
+		if err != nil {
+			s.deny(ctx, w, http.StatusUnauthorized, reason, err, "error reading token")
+			return
 		}
 
 		// Get claims from token
+		_, span = tracer.Start(ctx, "parse claims")
 		claims, err := jwt.TokenClaims(token)
+		endSpan(span, err)
 		if err != nil {
-			logAndError(w, http.StatusUnauthorized, err, "error reading claims from jwt token")
+			s.deny(ctx, w, http.StatusUnauthorized, reasonInvalidToken, err, "error reading claims from jwt token")
 			return
 		}
 
+		// possible values of Login claim are checked in cli beforehand
+		login, _, email := s.grafanaClaimsConfig.Identity(claims)
+
+		ctx = logging.NewContext(ctx, log.Fields{"login": login})
+		ctx = audit.NewContext(ctx, audit.Request{
+			RequestID: r.Header.Get(requestIDHeader),
+			TokenID:   claims.ID,
+			Issuer:    claims.Issuer,
+			Login:     login,
+			Email:     email,
+			Groups:    claims.Groups,
+		})
+
 		if claims.Subject == "" {
-			logAndError(w, http.StatusUnauthorized, err, "sub claim is empty")
+			s.deny(ctx, w, http.StatusUnauthorized, reasonEmptySub, err, "sub claim is empty")
 			return
 		}
 
-		// possible values of Login claim are checked in cli beforehand
-		login := getValidClaim(claims, s.grafanaClaimsConfig.Login)
-		name := getValidClaim(claims, s.grafanaClaimsConfig.Name)
-		email := claims.Email
+		if claims.ID != "" && s.denylist.contains(claims.ID) {
+			s.deny(ctx, w, http.StatusUnauthorized, reasonTokenDenied, errTokenDenied, "token is in the denylist")
+			return
+		}
 
-		log.Infof("user %s is attempting to log in", login)
-		log.Debugf("claim groups for user %s: %v", login, claims.Groups)
+		logger := logging.FromContext(ctx)
+		logger.Info("user is attempting to log in")
+		logger.Debugf("claim groups: %v", claims.Groups)
 
-		// validUserGroups represents the intersection of user groups from claim with the group
-		// mapping in configuration
-		validUserGroups := config.ValidUserGroups(claims.Groups, s.groups)
-		log.Debugf("valid user groups for user %s: %v", login, validUserGroups)
+		allowed := audit.Event{Event: audit.EVENT_LOGIN_ALLOWED}
 
-		orgUser, err := s.grafanaClient.GetOrCreateUser(login, name, email)
-		if err != nil {
-			logAndError(w, http.StatusUnauthorized, err, "error obtaining or creating user")
+		state, err := s.coalescedSyncUser(ctx, login, claims)
+		if denied := (*deniedError)(nil); errors.As(err, &denied) {
+			s.denyPage(ctx, w, r, login, denied)
 			return
 		}
 
-		userOrgsRole, err := s.grafanaClient.UpdateOrgUserAuthz(orgUser, validUserGroups)
 		if err != nil {
-			logAndError(w, http.StatusUnauthorized, err, "error updating global Grafana admin permissions")
-			return
-		}
+			if !grafana.IsUnavailable(err) {
+				code, reason := http.StatusUnauthorized, reasonGrafanaError
+				if errors.Is(err, grafana.ErrUserIdentityMismatch) {
+					code, reason = http.StatusForbidden, reasonIdentityMismatch
+				}
 
-		for orgID, role := range userOrgsRole {
-			err = s.grafanaClient.UpsertOrgUser(orgID, orgUser, string(role))
-			if err != nil {
-				// if an upsert fails we still allow the user to login as it will be assigned to
-				// the configured default Org and Role
-				log.Infof("err: %v", err)
-				log.Infof("failed to update role %s in orgID %d for user %s", string(role), orgID, login)
+				s.deny(ctx, w, code, reason, err, "error syncing user with Grafana")
+				return
+			}
+
+			// Grafana's admin API is down, users that were already synced keep
+			// their current roles in Grafana so they can still be proxied
+			cached, ok := s.syncCache.get(login)
+			if !ok {
+				w.Header().Set("Retry-After", retryAfter(err))
+				s.deny(ctx, w, http.StatusServiceUnavailable, reasonGrafanaUnavailable, err, "Grafana is unavailable")
+				return
 			}
+			state = cached
+
+			logger.WithError(err).Warn("Grafana is unavailable, user is proxied with its cached roles")
+			allowed.Reason = reasonGrafanaUnavailable
 		}
 
-		log.Infof("user %s is authorized to log in", login)
+		s.audit.Log(ctx, allowed)
+		logger.Info("user is authorized to log in")
+
+		// the user may have been found by email with another login, Grafana
+		// must sign in the user whose roles were synced
+		grafanaLogin := state.User.Login
+		if grafanaLogin == "" {
+			grafanaLogin = login
+		}
+		if grafanaLogin != login {
+			logger.WithField("grafana_login", grafanaLogin).Debug("user is linked to a Grafana user with another login")
+		}
 
 		r.Header.Set("X-Forwarded-Host", r.Host)
-		r.Header.Set(s.grafanaResponseHeaders.User, login)
+		r.Header.Set(s.grafanaResponseHeaders.User, grafanaLogin)
 
 		// Remove the Authorization header as it's not needed anymore and will conflict with Grafana's API access
 		r.Header.Del("Authorization")
 
-		// Create the reverse proxy
-		proxy := httputil.NewSingleHostReverseProxy(s.grafanaProxyUrl)
+		// the proxy serves an upgraded connection until it is closed
+		if isUpgrade(r) {
+			upgradeCtx, done := s.upgrades.track(r.Context())
+			defer done()
+			r = r.WithContext(upgradeCtx)
+		}
 
-		if s.skipTLSVerify {
-			proxy.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			}
+		s.proxy.ServeHTTP(w, r)
+	}
+}
+
+// deny answers a request that failed authentication with code, and records
+// the reason in the metrics and the audit log.
+func (s *Server) deny(ctx context.Context, w http.ResponseWriter, code int, reason string, err error, msg string) {
+	s.metrics.authFailure(reason)
+	s.audit.Log(ctx, audit.Event{Event: audit.EVENT_LOGIN_DENIED, Reason: reason})
+	logAndError(ctx, w, code, err, msg)
+}
+
+// requestToken returns the token from the configured header or cookie, and the
+// reason of the authentication failure when it is missing.
+func (s *Server) requestToken(r *http.Request) (string, string, error) {
+	if s.headerName != "" {
+		token := r.Header.Get(s.headerName)
+		// replicate the cookie look up behavior for a missing header
+		if token == "" {
+			return "", reasonMissingHeader, fmt.Errorf("No value for header %s", s.headerName)
 		}
 
-		proxy.ServeHTTP(w, r)
+		return token, "", nil
 	}
+
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return "", reasonMissingCookie, fmt.Errorf("error reading cookie %s: %w", s.cookieName, err)
+	}
+
+	return cookie.Value, "", nil
 }
 
 func (s *Server) handleHealthz() http.HandlerFunc {
@@ -163,15 +318,46 @@ func (s *Server) handleHealthz() http.HandlerFunc {
 
 		bytes, err := json.Marshal(status)
 		if err != nil {
-			logAndError(w, http.StatusBadRequest, err, "error gathering status")
+			logAndError(r.Context(), w, http.StatusBadRequest, err, "error gathering status")
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, string(bytes))
+	}
+}
+
+func (s *Server) handleReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks, ready, degraded := s.readiness.status()
+		status := readinessResponse{
+			Status: "ok",
+			Checks: checks,
+		}
+
+		code := http.StatusOK
+		switch {
+		case s.draining.Load():
+			status.Status = "draining"
+			code = http.StatusServiceUnavailable
+		case !ready:
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		case degraded:
+			status.Status = "degraded"
+		}
+
+		bytes, err := json.Marshal(status)
+		if err != nil {
+			logAndError(r.Context(), w, http.StatusBadRequest, err, "error gathering status")
 			return
 		}
 		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
 		fmt.Fprint(w, string(bytes))
 	}
 }
 
-func logAndError(w http.ResponseWriter, code int, err error, msg string) {
-	log.WithError(err).Error(msg)
+func logAndError(ctx context.Context, w http.ResponseWriter, code int, err error, msg string) {
+	logging.FromContext(ctx).WithError(err).Error(msg)
 	http.Error(w, http.StatusText(code), code)
 }
@@ -2,17 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/audit"
 	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -212,6 +220,596 @@ func TestHandleRoot(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestHandleRootLinkedByEmail(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-WEBAUTH-USER"))
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	// the Grafana user has another login but the same email as the token
+	client := grafana.NewMockClient(gapi.User{Login: "alice", Email: "jdoe@example.com", ID: 7}, nil)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Editor"}}}}),
+		WithGrafanaClient(client),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "auth_token", Value: newTestJWTToken("jdoe")})
+	server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Grafana signs in the user whose roles were synced
+	state, ok := server.syncCache.get("jdoe")
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), state.User.ID)
+	assert.Equal(t, map[int64]grafana.RoleType{1: grafana.ROLE_EDITOR}, state.OrgRoles)
+	assert.Equal(t, "alice", w.Body.String())
+}
+
+func TestHandleRootGrafanaUnavailable(t *testing.T) {
+	// the backendServer is both the proxied Grafana and its admin API, which
+	// can be taken down to simulate a restart
+	var grafanaDown atomic.Bool
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			fmt.Fprintln(w, "Hello, client")
+			return
+		}
+
+		if grafanaDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"message":"restarting"}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"id":1,"login":%q}`, r.URL.Query().Get("loginOrEmail"))
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	client, err := grafana.NewClient(backendURL, gapi.Config{Client: backendServer.Client()},
+		grafana.WithLookupStrategy(grafana.LOOKUP_LOGIN),
+		grafana.WithCircuitBreaker(grafana.BreakerConfig{Threshold: 1, Cooldown: time.Minute}),
+	)
+	assert.NoError(t, err)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(client),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	login := func(subject string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{
+			Name:  "auth_token",
+			Value: newTestJWTToken(subject),
+		})
+		server.ServeHTTP(w, req)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, login("jhon").Code)
+
+	grafanaDown.Store(true)
+
+	// known users are still proxied
+	assert.Equal(t, http.StatusOK, login("jhon").Code)
+
+	// unknown users are asked to come back once the breaker closes
+	w := login("jane")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestHandleRootConcurrentFirstLogin(t *testing.T) {
+	// the admin API is slow enough for all the requests to overlap and only
+	// knows the user once it has been created
+	var created atomic.Bool
+	var createCalls atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/users/lookup":
+			time.Sleep(50 * time.Millisecond)
+			if !created.Load() {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message":"user not found"}`)
+				return
+			}
+			fmt.Fprint(w, `{"id":1,"login":"jhon"}`)
+		case r.URL.Path == "/api/admin/users":
+			createCalls.Add(1)
+			if created.Swap(true) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `{"message":"user already exists"}`)
+				return
+			}
+			fmt.Fprint(w, `{"id":1}`)
+		case strings.HasPrefix(r.URL.Path, "/api/"):
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprintln(w, "Hello, client")
+		}
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	client, err := grafana.NewClient(backendURL, gapi.Config{Client: backendServer.Client()})
+	assert.NoError(t, err)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(client),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	token := newTestJWTToken("jhon")
+	codes := make([]int, 20)
+
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{
+				Name:  "auth_token",
+				Value: token,
+			})
+			server.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, int32(1), createCalls.Load())
+}
+
+func TestHandleRootAudit(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	buf := &bytes.Buffer{}
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+		WithAuditLogger(audit.New(buf)),
+	)
+	assert.NoError(t, err)
+
+	cl := jwt.Claims{Groups: []string{"foo"}}
+	cl.Subject = "jhon"
+	cl.ID = "token-id"
+	cl.Issuer = "https://issuer.example.com"
+	token, err := jwt.NewTestJWTWithClaims(cl)
+	assert.NoError(t, err)
+
+	for _, value := range []string{"this-is-no-valid-jwt", token} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "request-"+value[:4])
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: value})
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	events := []audit.Event{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e audit.Event
+		assert.NoError(t, dec.Decode(&e))
+		e.Time = time.Time{}
+		events = append(events, e)
+	}
+
+	assert.Equal(t, []audit.Event{
+		{
+			Event:     audit.EVENT_LOGIN_DENIED,
+			RequestID: "request-this",
+			Reason:    reasonInvalidToken,
+		},
+		{
+			Event:     audit.EVENT_LOGIN_ALLOWED,
+			RequestID: "request-" + token[:4],
+			TokenID:   "token-id",
+			Issuer:    "https://issuer.example.com",
+			Login:     "jhon",
+			Groups:    []string{"foo"},
+		},
+	}, events)
+}
+
+func TestSetGroups(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Viewer"}}}}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	login := func() {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: newTestJWTToken("jhon")})
+		server.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	login()
+	state, ok := server.syncCache.get("jhon")
+	assert.True(t, ok)
+	assert.Equal(t, map[int64]grafana.RoleType{1: grafana.ROLE_VIEWER}, state.OrgRoles)
+
+	// the cached roles were resolved from the previous groups
+	groups := config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Editor"}}}}
+	server.SetGroups(groups)
+	assert.Equal(t, groups, server.Groups())
+	_, ok = server.syncCache.get("jhon")
+	assert.False(t, ok)
+
+	login()
+	state, ok = server.syncCache.get("jhon")
+	assert.True(t, ok)
+	assert.Equal(t, map[int64]grafana.RoleType{1: grafana.ROLE_EDITOR}, state.OrgRoles)
+}
+
+func TestSetGroupsDuringSync(t *testing.T) {
+	// the first lookup is held until the groups are replaced
+	lookupStarted := make(chan struct{})
+	releaseLookup := make(chan struct{})
+	var lookups atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/users/lookup":
+			if lookups.Add(1) == 1 {
+				close(lookupStarted)
+				<-releaseLookup
+			}
+			fmt.Fprint(w, `{"id":1,"login":"jhon"}`)
+		case strings.HasPrefix(r.URL.Path, "/api/"):
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprintln(w, "Hello, client")
+		}
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	client, err := grafana.NewClient(backendURL, gapi.Config{Client: backendServer.Client()})
+	assert.NoError(t, err)
+
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigGroups(config.Groups{}),
+		WithGrafanaClient(client),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+	)
+	assert.NoError(t, err)
+
+	login := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: newTestJWTToken("jhon")})
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- login() }()
+
+	<-lookupStarted
+	server.SetGroups(config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Editor"}}}})
+
+	// a login after the new groups doesn't share the sync in flight
+	assert.Equal(t, http.StatusOK, login())
+	_, ok := server.syncCache.get("jhon")
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), lookups.Load())
+
+	// the sync started with the previous groups doesn't replace the cached
+	// state
+	server.syncCache.clear()
+	close(releaseLookup)
+	assert.Equal(t, http.StatusOK, <-done)
+	_, ok = server.syncCache.get("jhon")
+	assert.False(t, ok)
+}
+
+func TestHandleRootRules(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	authz := config.Authz{
+		Groups: config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Viewer"}}}},
+		Rules: config.Rules{
+			{
+				Name: "mfa",
+				When: []config.Condition{{Claim: "acr", Equals: "mfa", Not: true}},
+				Deny: true,
+			},
+			{
+				Name: "team admins",
+				When: []config.Condition{{Claim: "groups", Matches: "^team-(.*)-admins$"}},
+				Orgs: []config.Org{{Name: "$1", Role: "Admin"}},
+			},
+		},
+	}
+	assert.NoError(t, authz.Validate())
+
+	buf := &bytes.Buffer{}
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigAuthz(authz),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+		WithAuditLogger(audit.New(buf)),
+	)
+	assert.NoError(t, err)
+
+	login := func(acr string) int {
+		cl := jwt.Claims{Groups: []string{"foo", "team-Payments-admins"}, Raw: map[string]interface{}{"acr": acr}}
+		cl.Subject = "jhon"
+		token, err := jwt.NewTestJWTWithClaims(cl)
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the user is not synced with Grafana
+	assert.Equal(t, http.StatusForbidden, login("pwd"))
+	_, ok := server.syncCache.get("jhon")
+	assert.False(t, ok)
+	assert.Contains(t, buf.String(), `"reason":"rule_denied"`)
+
+	assert.Equal(t, http.StatusOK, login("mfa"))
+	state, ok := server.syncCache.get("jhon")
+	assert.True(t, ok)
+	// the org named by the rule is Payments, 2 in the mock
+	assert.Equal(t, map[int64]grafana.RoleType{1: grafana.ROLE_VIEWER, 2: grafana.ROLE_ADMIN}, state.OrgRoles)
+
+	// the rules are kept when the groups change
+	server.SetGroups(config.Groups{})
+	assert.Equal(t, http.StatusForbidden, login("pwd"))
+}
+
+func TestHandleRootRestrictions(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	authz := config.Authz{
+		Groups:              config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Viewer"}}}},
+		DenyGroups:          []string{"contractors-*"},
+		RequiredGroups:      []string{"foo", "bar"},
+		AllowedEmailDomains: []string{"example.com"},
+	}
+	assert.NoError(t, authz.Validate())
+
+	tests := []struct {
+		description string
+		groups      []string
+		email       string
+		page        *template.Template
+		wantCode    int
+		wantReason  string
+		wantBody    string
+	}{
+		{
+			description: "Allowed",
+			groups:      []string{"foo"},
+			email:       "jhon@example.com",
+			wantCode:    http.StatusOK,
+			wantBody:    "Hello, client",
+		},
+		{
+			description: "Deny group",
+			groups:      []string{"foo", "contractors-acme"},
+			email:       "jhon@example.com",
+			wantCode:    http.StatusForbidden,
+			wantReason:  config.DENIED_BY_GROUP,
+			wantBody:    "jhon, you are not allowed to access Grafana",
+		},
+		{
+			description: "Missing required group",
+			groups:      []string{"baz"},
+			email:       "jhon@example.com",
+			wantCode:    http.StatusForbidden,
+			wantReason:  config.DENIED_BY_REQUIRED_GROUP,
+			wantBody:    "request ID test-request",
+		},
+		{
+			description: "Email domain not allowed",
+			groups:      []string{"foo"},
+			email:       "jhon@example.org",
+			page:        template.Must(template.New("denied").Parse("<p>{{.Login}}: {{.Reason}}</p>")),
+			wantCode:    http.StatusForbidden,
+			wantReason:  config.DENIED_BY_EMAIL_DOMAIN,
+			wantBody:    "<p>jhon: email_domain_not_allowed</p>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			server, err := New(
+				WithGrafanaProxyURL(backendURL),
+				WithCookieName("auth_token"),
+				WithConfigAuthz(authz),
+				WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+				WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+					User: "X-WEBAUTH-USER",
+				}),
+				WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+					Login: "sub",
+				}),
+				WithAuditLogger(audit.New(buf)),
+				WithDeniedPage(test.page),
+			)
+			assert.NoError(t, err)
+
+			cl := jwt.Claims{Email: test.email, Groups: test.groups}
+			cl.Subject = "jhon"
+			token, err := jwt.NewTestJWTWithClaims(cl)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Request-ID", "test-request")
+			req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+			server.ServeHTTP(w, req)
+
+			assert.Equal(t, test.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), test.wantBody)
+
+			// a denied user is never synced with Grafana
+			_, ok := server.syncCache.get("jhon")
+			assert.Equal(t, test.wantCode == http.StatusOK, ok)
+
+			if test.wantReason != "" {
+				assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Contains(t, buf.String(), fmt.Sprintf(`"reason":%q`, test.wantReason))
+			}
+		})
+	}
+}
+
+func TestHandleRootDefaultGrants(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	buf := &bytes.Buffer{}
+	server, err := New(
+		WithGrafanaProxyURL(backendURL),
+		WithCookieName("auth_token"),
+		WithConfigAuthz(config.Authz{
+			Groups:        config.Groups{"admins": {Orgs: []config.Org{{ID: 1, Role: "Admin"}}}},
+			DefaultGrants: config.DefaultGrants{Orgs: []config.Org{{Name: "Payments", Role: "Viewer"}}},
+		}),
+		WithGrafanaClient(grafana.NewMockClient(gapi.User{Login: "jhon", ID: 1}, nil)),
+		WithGrafanaResponseHeaders(GrafanaResponseHeaders{
+			User: "X-WEBAUTH-USER",
+		}),
+		WithGrafanaClaimsConfig(GrafanaClaimsConfig{
+			Login: "sub",
+		}),
+		WithAuditLogger(audit.New(buf)),
+	)
+	assert.NoError(t, err)
+
+	login := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: newTestJWTToken("jhon")})
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// foo and bar are not mapped, the user gets the default grants
+	assert.Equal(t, http.StatusOK, login())
+	state, ok := server.syncCache.get("jhon")
+	assert.True(t, ok)
+	assert.Equal(t, map[int64]grafana.RoleType{2: grafana.ROLE_VIEWER}, state.OrgRoles)
+
+	server.SetAuthz(config.Authz{
+		Groups:        config.Groups{"admins": {Orgs: []config.Org{{ID: 1, Role: "Admin"}}}},
+		DefaultGrants: config.DefaultGrants{NoAccess: true},
+	})
+
+	assert.Equal(t, http.StatusForbidden, login())
+	_, ok = server.syncCache.get("jhon")
+	assert.False(t, ok)
+	assert.Contains(t, buf.String(), `"reason":"no_grants"`)
+}
+
+func TestWithDeniedPage(t *testing.T) {
+	_, err := New(WithDeniedPage(template.Must(template.New("denied").Parse("{{.Login}} {{.Reason}} {{.RequestID}}"))))
+	assert.NoError(t, err)
+
+	_, err = New(WithDeniedPage(template.Must(template.New("denied").Parse("{{.Groups}}"))))
+	assert.ErrorContains(t, err, "invalid denied page")
+}
+
 func TestHandleHealthz(t *testing.T) {
 	server, err := New()
 	assert.NoError(t, err)
@@ -232,6 +830,149 @@ func TestHandleHealthz(t *testing.T) {
 	assert.Equal(t, want, got)
 }
 
+func TestHandleReadyz(t *testing.T) {
+	server, err := New()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		drain bool
+		code  int
+		want  string
+	}{
+		{
+			code: http.StatusOK,
+			want: "ok",
+		},
+		{
+			drain: true,
+			code:  http.StatusServiceUnavailable,
+			want:  "draining",
+		},
+	}
+
+	for _, test := range tests {
+		if test.drain {
+			server.Drain()
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		server.ServeHTTP(w, req)
+		assert.Equal(t, test.code, w.Code)
+
+		got := readinessResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), &got)
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, got.Status)
+	}
+}
+
+func TestHandleReadyzChecks(t *testing.T) {
+	var adminStatus atomic.Int32
+	adminStatus.Store(http.StatusOK)
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/health":
+			fmt.Fprint(w, `{"database":"ok"}`)
+		case "/api/orgs":
+			w.WriteHeader(int(adminStatus.Load()))
+			if adminStatus.Load() != http.StatusOK {
+				fmt.Fprint(w, `{"message":"invalid username or password"}`)
+				return
+			}
+			fmt.Fprint(w, `[{"id":1,"name":"Main Org."}]`)
+		}
+	}))
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL)
+
+	client, err := grafana.NewClient(backendURL, gapi.Config{Client: backendServer.Client()})
+	assert.NoError(t, err)
+
+	server, err := New(WithGrafanaProxyURL(backendURL), WithGrafanaClient(client))
+	assert.NoError(t, err)
+
+	readyz := func() (int, readinessResponse) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		got := readinessResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+
+		return w.Code, got
+	}
+
+	// not ready until the checks have run
+	code, got := readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "pending", got.Checks["grafana_health"].Status)
+
+	server.readiness.run(context.Background())
+	code, got = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", got.Status)
+	assert.Equal(t, "ok", got.Checks["grafana_health"].Status)
+	assert.Equal(t, "ok", got.Checks["grafana_admin_api"].Status)
+
+	// wrong admin credentials
+	adminStatus.Store(http.StatusUnauthorized)
+	server.readiness.run(context.Background())
+	code, got = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", got.Status)
+	assert.Equal(t, "ok", got.Checks["grafana_health"].Status)
+	assert.Equal(t, "error", got.Checks["grafana_admin_api"].Status)
+	assert.Contains(t, got.Checks["grafana_admin_api"].Error, "invalid username or password")
+
+	// the admin API is down and no user can be served from the cache
+	adminStatus.Store(http.StatusServiceUnavailable)
+	server.readiness.run(context.Background())
+	code, got = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "error", got.Checks["grafana_admin_api"].Status)
+
+	// the users already synced can still be proxied
+	server.syncCache.set("jhon", userSyncState{User: gapi.User{Login: "jhon", ID: 1}})
+	server.readiness.run(context.Background())
+	code, got = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "degraded", got.Status)
+	assert.Equal(t, "degraded", got.Checks["grafana_admin_api"].Status)
+
+	// wrong credentials are not degraded, whatever the cache
+	adminStatus.Store(http.StatusUnauthorized)
+	server.readiness.run(context.Background())
+	code, got = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "error", got.Checks["grafana_admin_api"].Status)
+}
+
+func TestHandleMetrics(t *testing.T) {
+	server, err := New(
+		WithCookieName("auth_token"),
+		WithMetricsRegistry(prometheus.NewRegistry()),
+	)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "auth_token", Value: "this-is-no-valid-jwt"})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `grafana_auth_proxy_authentication_failures_total{reason="invalid_token"} 1`)
+	assert.Contains(t, w.Body.String(), `grafana_auth_proxy_http_requests_total{code="401",method="get"} 1`)
+
+	// /metrics of the proxy listener is Grafana's, it requires a token
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
 func TestGetValidClaim(t *testing.T) {
 	claims := &jwt.Claims{
 		Email: fmt.Sprintf("%s@example.com", "jhon.doe"),
@@ -257,3 +998,17 @@ func TestGetValidClaim(t *testing.T) {
 		assert.Equal(t, test.expected, value)
 	}
 }
+
+func TestGrafanaClaimsConfigIdentity(t *testing.T) {
+	claims := &jwt.Claims{Email: "jhon.doe@example.com"}
+	claims.Subject = "jhon.doe"
+
+	login, name, email := GrafanaClaimsConfig{Login: "email", Name: "sub"}.Identity(claims)
+	assert.Equal(t, "jhon.doe@example.com", login)
+	assert.Equal(t, "jhon.doe", name)
+	assert.Equal(t, "jhon.doe@example.com", email)
+
+	login, name, _ = GrafanaClaimsConfig{Login: "sub", Name: "email"}.Identity(claims)
+	assert.Equal(t, "jhon.doe", login)
+	assert.Equal(t, "jhon.doe@example.com", name)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/jwt"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultRetryAfter is sent to clients when Grafana is unavailable but the
+// circuit breaker can't tell when it will be reachable again.
+const defaultRetryAfter = 5 * time.Second
+
+// userSyncState is the result of the last successful sync of a user with
+// Grafana, and the claims it was synced from.
+type userSyncState struct {
+	User     gapi.User
+	OrgRoles map[int64]grafana.RoleType
+	SyncedAt time.Time
+	Claims   *jwt.Claims
+}
+
+// syncCache keeps the last sync state per login, it is used to keep serving
+// known users while Grafana's admin API is unavailable. Its generation is
+// bumped every time it is cleared, so the syncs started before are not
+// stored.
+type syncCache struct {
+	mu         sync.RWMutex
+	users      map[string]userSyncState
+	generation uint64
+}
+
+func newSyncCache() *syncCache {
+	return &syncCache{users: make(map[string]userSyncState)}
+}
+
+func (c *syncCache) get(login string) (userSyncState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state, ok := c.users[login]
+	return state, ok
+}
+
+func (c *syncCache) set(login string, state userSyncState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users[login] = state
+}
+
+// currentGeneration returns the generation new syncs are started in.
+func (c *syncCache) currentGeneration() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.generation
+}
+
+// setIfGeneration stores the state of login only when the cache wasn't
+// cleared since generation, and reports whether it was stored.
+func (c *syncCache) setIfGeneration(login string, state userSyncState, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return false
+	}
+
+	c.users[login] = state
+
+	return true
+}
+
+// delete removes the state of login and reports whether it was cached.
+func (c *syncCache) delete(login string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.users[login]
+	delete(c.users, login)
+
+	return ok
+}
+
+// list returns the states of every login.
+func (c *syncCache) list() map[string]userSyncState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	users := make(map[string]userSyncState, len(c.users))
+	for login, state := range c.users {
+		users[login] = state
+	}
+
+	return users
+}
+
+// len returns the number of cached logins.
+func (c *syncCache) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.users)
+}
+
+func (c *syncCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users = make(map[string]userSyncState)
+	c.generation++
+}
+
+// coalescedSyncUser runs syncUser once for all the concurrent requests of the
+// same login, the browser fires dozens of them when a dashboard is opened. The
+// requests that arrive while a sync is in flight wait for and share its
+// result. A sync started before the config was replaced isn't shared with
+// the requests that come after, and its result isn't cached.
+func (s *Server) coalescedSyncUser(ctx context.Context, login string, claims *jwt.Claims) (_ userSyncState, err error) {
+	ctx, span := tracer.Start(ctx, "sync user", trace.WithAttributes(semconv.EnduserID(login)))
+	defer func() { endSpan(span, err) }()
+
+	// the generation is read before the config, SetAuthz replaces the config
+	// before it clears the cache
+	generation := s.syncCache.currentGeneration()
+	key := strconv.FormatUint(generation, 10) + "/" + login
+
+	v, err, shared := s.syncGroup.Do(key, func() (interface{}, error) {
+		// the sync is shared, so it must not be cancelled with the request
+		// that happened to start it
+		state, err := s.syncUser(context.WithoutCancel(ctx), login, claims)
+		if err == nil && !s.syncCache.setIfGeneration(login, state, generation) {
+			logging.FromContext(ctx).Debug("config was replaced during the sync of user, its result isn't cached")
+		}
+
+		return state, err
+	})
+
+	span.SetAttributes(attribute.Bool("sync.shared", shared))
+	if shared {
+		logging.FromContext(ctx).Debug("sync of user was shared with concurrent requests")
+	}
+
+	return v.(userSyncState), err
+}
+
+// syncUser makes sure the user exists in Grafana and that its global admin
+// flag, roles per org and teams match the groups of the claims that are
+// mapped in the config and the rules that match the claims. A user denied by
+// the config is never created.
+func (s *Server) syncUser(ctx context.Context, login string, claims *jwt.Claims) (userSyncState, error) {
+	_, name, email := s.grafanaClaimsConfig.Identity(claims)
+
+	resolution := s.Authz().Resolve(claims.Map())
+	logger := logging.FromContext(ctx)
+	logger.Debugf("matched rules: %v", resolution.Rules)
+
+	if resolution.Denied != "" {
+		return userSyncState{}, &deniedError{reason: resolution.Denied, denial: resolution.Denial()}
+	}
+
+	// the groups of the claims that are mapped in the config, and the grants
+	// of the rules
+	logger.Debugf("valid user groups: %v", resolution.Groups)
+
+	user, orgRoles, err := s.grafanaClient.SyncUser(ctx, login, name, email, resolution.Groups)
+	if err != nil {
+		return userSyncState{}, err
+	}
+
+	return userSyncState{
+		User:     user,
+		OrgRoles: orgRoles,
+		SyncedAt: time.Now(),
+		Claims:   claims,
+	}, nil
+}
+
+// retryAfter returns the value of the Retry-After header, in seconds, for an
+// error caused by Grafana being unavailable.
+func retryAfter(err error) string {
+	wait := defaultRetryAfter
+
+	var openErr *grafana.CircuitOpenError
+	if errors.As(err, &openErr) {
+		wait = openErr.RetryAfter
+	}
+
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,170 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoCertificates = errors.New("no certificates found in CA bundle")
+	ErrKeyPair        = errors.New("client certificate and key must be set together")
+)
+
+// ClientFiles are the files used to build the TLS configuration of
+// connections to Grafana. Empty values keep Go's defaults.
+type ClientFiles struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	// Host is the host of Grafana's URL. The certificate is verified against
+	// it when the connection has no server name, like with an IP address.
+	Host string
+}
+
+// Client provides a TLS configuration for connections to Grafana that trusts
+// a CA bundle and presents a client certificate, both loaded from files that
+// can be reloaded without rebuilding the configuration.
+type Client struct {
+	files ClientFiles
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+	cert *tls.Certificate
+}
+
+// NewClient loads the files and returns a Client.
+func NewClient(files ClientFiles) (*Client, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, ErrKeyPair
+	}
+
+	c := &Client{files: files}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the files again. On error the previous certificates are kept.
+func (c *Client) Reload() error {
+	var pool *x509.CertPool
+	if c.files.CAFile != "" {
+		var err error
+		pool, err = loadCertPool(c.files.CAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cert *tls.Certificate
+	if c.files.CertFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(c.files.CertFile, c.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cert = &keyPair
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pool = pool
+	c.cert = cert
+
+	return nil
+}
+
+// Watch reloads the files every time they change until ctx is done.
+func (c *Client) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, []string{c.files.CAFile, c.files.CertFile, c.files.KeyFile}, func() {
+		if err := c.Reload(); err != nil {
+			log.WithError(err).Error("error reloading Grafana TLS certificates, keeping the previous ones")
+			return
+		}
+
+		log.Info("reloaded Grafana TLS certificates")
+	})
+}
+
+// Config returns a TLS configuration that always uses the last loaded
+// certificates.
+func (c *Client) Config() *tls.Config {
+	cfg := &tls.Config{
+		InsecureSkipVerify: c.files.InsecureSkipVerify,
+	}
+
+	if c.files.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			return c.cert, nil
+		}
+	}
+
+	// RootCAs can't be changed once the configuration is in use, so the
+	// default verification is replaced by one that uses the current pool
+	if c.files.CAFile != "" && !c.files.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = c.verifyConnection
+	}
+
+	return cfg
+}
+
+func (c *Client) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate presented")
+	}
+
+	// there is no server name for IP addresses, an empty name would skip
+	// the verification of the host
+	host := cs.ServerName
+	if host == "" {
+		host = c.files.Host
+	}
+	if host == "" {
+		return errors.New("no host to verify the server certificate against")
+	}
+
+	c.mu.RLock()
+	pool := c.pool
+	c.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("%w: %s", ErrNoCertificates, file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,213 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA, valid for
+// localhost as a server and as a client.
+func (ca *testCA) issue(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+
+	return ca.issueFor(t, commonName, []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1")})
+}
+
+// issueFor returns a PEM encoded certificate and key signed by the CA, valid
+// for dnsNames and ips.
+func (ca *testCA) issueFor(t *testing.T, commonName string, dnsNames []string, ips []net.IP) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(file, content, 0600))
+
+	return file
+}
+
+func TestNewClientErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := NewClient(ClientFiles{CertFile: "tls.crt"})
+	assert.ErrorIs(t, err, ErrKeyPair)
+
+	_, err = NewClient(ClientFiles{CAFile: writeFile(t, dir, "ca.crt", []byte("not a pem"))})
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	_, err = NewClient(ClientFiles{CAFile: filepath.Join(dir, "missing.crt")})
+	assert.Error(t, err)
+}
+
+func TestClientMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	serverCA := newTestCA(t)
+	clientCA := newTestCA(t)
+
+	serverCert, serverKey := serverCA.issue(t, "grafana")
+	serverKeyPair, err := tls.X509KeyPair(serverCert, serverKey)
+	assert.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// trust an unrelated CA first
+	otherCA := newTestCA(t)
+	clientCert, clientKey := clientCA.issue(t, "grafana-auth-proxy")
+	files := ClientFiles{
+		CAFile:   writeFile(t, dir, "ca.crt", otherCA.pem),
+		CertFile: writeFile(t, dir, "tls.crt", clientCert),
+		KeyFile:  writeFile(t, dir, "tls.key", clientKey),
+		Host:     "127.0.0.1",
+	}
+
+	client, err := NewClient(files)
+	assert.NoError(t, err)
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: client.Config()}}
+
+	_, err = httpClient.Get(backend.URL)
+	assert.Error(t, err)
+
+	// the new CA is used by the existing configuration after a reload
+	writeFile(t, dir, "ca.crt", serverCA.pem)
+	assert.NoError(t, client.Reload())
+
+	resp, err := httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// a broken file keeps the previous certificates
+	writeFile(t, dir, "ca.crt", []byte("not a pem"))
+	assert.Error(t, client.Reload())
+
+	httpClient.CloseIdleConnections()
+	resp, err = httpClient.Get(backend.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestClientVerifiesIPHost(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t)
+
+	// the certificate is trusted but issued for another name
+	serverCert, serverKey := ca.issueFor(t, "grafana", []string{"grafana.example.com"}, nil)
+	serverKeyPair, err := tls.X509KeyPair(serverCert, serverKey)
+	assert.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{serverKeyPair}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", backendURL.Hostname())
+
+	client, err := NewClient(ClientFiles{
+		CAFile: writeFile(t, dir, "ca.crt", ca.pem),
+		Host:   backendURL.Hostname(),
+	})
+	assert.NoError(t, err)
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: client.Config()}}
+
+	_, err = httpClient.Get(backend.URL)
+	assert.ErrorContains(t, err, "127.0.0.1")
+}
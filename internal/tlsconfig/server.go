@@ -0,0 +1,96 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/internal/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrServerKeyPair = errors.New("server certificate and key are required")
+
+// ServerFiles are the files used to serve TLS. When ClientCAFile is set
+// clients must present a certificate signed by one of its CAs.
+type ServerFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Server provides a TLS configuration to serve connections with
+// certificates loaded from files that can be reloaded while serving.
+type Server struct {
+	files   ServerFiles
+	current atomic.Pointer[tls.Config]
+}
+
+// NewServer loads the files and returns a Server.
+func NewServer(files ServerFiles) (*Server, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, ErrServerKeyPair
+	}
+
+	s := &Server{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads the files again. On error the previous certificates are kept.
+func (s *Server) Reload() error {
+	keyPair, err := tls.LoadX509KeyPair(s.files.CertFile, s.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keyPair},
+		// the configuration returned by GetConfigForClient replaces the one
+		// http.Server sets up, so HTTP/2 has to be offered here
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if s.files.ClientCAFile != "" {
+		pool, err := loadCertPool(s.files.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	s.current.Store(cfg)
+
+	return nil
+}
+
+// Watch reloads the files every time they change until ctx is done.
+func (s *Server) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, []string{s.files.CertFile, s.files.KeyFile, s.files.ClientCAFile}, func() {
+		if err := s.Reload(); err != nil {
+			log.WithError(err).Error("error reloading server TLS certificates, keeping the previous ones")
+			return
+		}
+
+		log.Info("reloaded server TLS certificates")
+	})
+}
+
+// Config returns a TLS configuration that uses the last loaded certificates
+// for every new connection.
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current.Load(), nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewServerErrors(t *testing.T) {
+	_, err := NewServer(ServerFiles{CertFile: "tls.crt"})
+	assert.ErrorIs(t, err, ErrServerKeyPair)
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "grafana-auth-proxy")
+
+	_, err = NewServer(ServerFiles{
+		CertFile:     writeFile(t, dir, "tls.crt", cert),
+		KeyFile:      writeFile(t, dir, "tls.key", key),
+		ClientCAFile: writeFile(t, dir, "ca.crt", []byte("not a pem")),
+	})
+	assert.ErrorIs(t, err, ErrNoCertificates)
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "first")
+	files := ServerFiles{
+		CertFile: writeFile(t, dir, "tls.crt", cert),
+		KeyFile:  writeFile(t, dir, "tls.key", key),
+	}
+
+	server, err := NewServer(files)
+	assert.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = server.Config()
+	backend.StartTLS()
+	defer backend.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	servedCommonName := func() string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get(backend.URL)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal(t, "first", servedCommonName())
+
+	// rotated certificates are served to new connections
+	cert, key = ca.issue(t, "second")
+	writeFile(t, dir, "tls.crt", cert)
+	writeFile(t, dir, "tls.key", key)
+	assert.NoError(t, server.Reload())
+	assert.Equal(t, "second", servedCommonName())
+
+	// a broken file keeps the previous certificate
+	writeFile(t, dir, "tls.key", []byte("not a key"))
+	assert.Error(t, server.Reload())
+	assert.Equal(t, "second", servedCommonName())
+}
+
+func TestServerClientCA(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "grafana-auth-proxy")
+
+	server, err := NewServer(ServerFiles{
+		CertFile:     writeFile(t, dir, "tls.crt", cert),
+		KeyFile:      writeFile(t, dir, "tls.key", key),
+		ClientCAFile: writeFile(t, dir, "ca.crt", ca.pem),
+	})
+	assert.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = server.Config()
+	backend.StartTLS()
+	defer backend.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// connections without a client certificate are rejected
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get(backend.URL)
+	assert.Error(t, err)
+
+	clientCert, clientKey := ca.issue(t, "client")
+	keyPair, err := tls.X509KeyPair(clientCert, clientKey)
+	assert.NoError(t, err)
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{keyPair},
+	}}}
+	resp, err := client.Get(backend.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Exporters spans can be sent to
+const (
+	EXPORTER_NONE      = "none"
+	EXPORTER_OTLP_GRPC = "otlp-grpc"
+	EXPORTER_OTLP_HTTP = "otlp-http"
+	EXPORTER_STDOUT    = "stdout"
+)
+
+const serviceName = "grafana-auth-proxy"
+
+var ErrExporterNotValid = errors.New("tracing exporter is not valid")
+
+// Config selects where spans are exported. The OTLP exporters also honor the
+// standard OTEL_EXPORTER_OTLP_* environment variables, Endpoint and Insecure
+// take precedence when set.
+type Config struct {
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans and must be called
+// on shutdown. With EXPORTER_NONE nothing is installed and spans are no-ops.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	exporter, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case "", EXPORTER_NONE:
+		return nil, nil
+	case EXPORTER_STDOUT:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case EXPORTER_OTLP_GRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+
+		return otlptracegrpc.New(ctx, opts...)
+	case EXPORTER_OTLP_HTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrExporterNotValid, cfg.Exporter)
+}
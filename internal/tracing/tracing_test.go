@@ -0,0 +1,21 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := Setup(ctx, Config{Exporter: "zipkin"})
+	assert.ErrorIs(t, err, ErrExporterNotValid)
+
+	for _, exporter := range []string{"", EXPORTER_NONE, EXPORTER_STDOUT, EXPORTER_OTLP_GRPC, EXPORTER_OTLP_HTTP} {
+		shutdown, err := Setup(ctx, Config{Exporter: exporter, Endpoint: "localhost:4317", Insecure: true, SampleRatio: 1})
+		assert.NoError(t, err, exporter)
+		assert.NoError(t, shutdown(ctx), exporter)
+	}
+}
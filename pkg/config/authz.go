@@ -0,0 +1,250 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Authz is everything in the config that decides who can log in and what
+// they get in Grafana.
+type Authz struct {
+	Groups Groups `json:"groups"`
+	Rules  Rules  `json:"rules,omitempty"`
+	// DenyGroups deny the login of the users in any of them.
+	DenyGroups []string `json:"denyGroups,omitempty"`
+	// RequiredGroups deny the login of the users in none of them.
+	RequiredGroups []string `json:"requiredGroups,omitempty"`
+	// AllowedEmailDomains deny the login of the users whose email claim is
+	// not in one of them.
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+	// DefaultGrants apply to the users that get nothing from the groups and
+	// the rules, instead of Grafana's auto_assign_org_role.
+	DefaultGrants DefaultGrants `json:"defaultGrants,omitzero"`
+
+	// patterns are the group patterns compiled by Validate.
+	patterns groupPatterns
+}
+
+// DefaultGrants are the orgs and teams of the users without any grant, or
+// NoAccess to deny their login. When it is empty those users get Grafana's
+// default org and role.
+type DefaultGrants struct {
+	NoAccess bool   `json:"noAccess,omitempty"`
+	Orgs     []Org  `json:"orgs,omitempty"`
+	Teams    []Team `json:"teams,omitempty"`
+}
+
+// IsZero reports whether no default grants are set.
+func (d DefaultGrants) IsZero() bool {
+	return !d.NoAccess && len(d.Orgs) == 0 && len(d.Teams) == 0
+}
+
+// problems returns the problems of the default grants.
+func (d DefaultGrants) problems() []string {
+	if d.NoAccess && (len(d.Orgs) > 0 || len(d.Teams) > 0) {
+		return []string{"noAccess can't be set with orgs or teams"}
+	}
+
+	return validateGrants(d.Orgs, d.Teams, false)
+}
+
+// Validate validates the groups, the rules, the login restrictions and the
+// default grants, and prepares the rules and the group patterns to be
+// evaluated. All the problems found are returned joined in a single error.
+func (a *Authz) Validate() error {
+	patterns := groupPatterns{}
+	errs := []error{a.Groups.validate(patterns), a.Rules.Validate()}
+
+	lists := []struct {
+		name   string
+		groups []string
+	}{
+		{"denyGroups", a.DenyGroups},
+		{"requiredGroups", a.RequiredGroups},
+	}
+	for _, list := range lists {
+		for i, group := range list.groups {
+			if !IsGroupPattern(group) {
+				continue
+			}
+
+			re, err := compileGroupPattern(group)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %d: %w", list.name, i, err))
+				continue
+			}
+			patterns[group] = re
+		}
+	}
+	// a config without patterns is left equal to its literal
+	a.patterns = nil
+	if len(patterns) > 0 {
+		a.patterns = patterns
+	}
+
+	for _, problem := range a.DefaultGrants.problems() {
+		errs = append(errs, fmt.Errorf("defaultGrants: %s", problem))
+	}
+
+	for i, domain := range a.AllowedEmailDomains {
+		if domain == "" || strings.Contains(domain, "@") {
+			errs = append(errs, fmt.Errorf("allowedEmailDomains %d: %q is not a domain", i, domain))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rulePrefix prefixes the grants of rules in Resolution.Groups so they never
+// collide with the name of a group.
+const rulePrefix = "rule:"
+
+// defaultGroup is the key of the default grants in Resolution.Groups.
+const defaultGroup = "default:"
+
+// Reasons a login is denied by the config
+const (
+	DENIED_BY_GROUP          = "deny_group"
+	DENIED_BY_REQUIRED_GROUP = "missing_required_group"
+	DENIED_BY_EMAIL_DOMAIN   = "email_domain_not_allowed"
+	DENIED_BY_RULE           = "rule_denied"
+	DENIED_BY_NO_GRANTS      = "no_grants"
+)
+
+// Resolution is what a user gets from the groups and the rules of the config.
+type Resolution struct {
+	// Groups has the grants of the groups of the user that are mapped, by
+	// group name, and of the rules that matched, by rule name prefixed with
+	// "rule:".
+	Groups Groups
+	// Default is set when the user got the default grants.
+	Default bool
+	// Rules are the names of the rules that matched, in order.
+	Rules []string
+	// Denied is the reason the login is denied, one of the DENIED_BY
+	// constants, or empty when it is allowed.
+	Denied string
+	// DeniedBy is the deny group, email domain or rule that denied the
+	// login.
+	DeniedBy string
+}
+
+// Denial describes why the login is denied, it is empty when it is allowed.
+func (r Resolution) Denial() string {
+	switch r.Denied {
+	case DENIED_BY_GROUP:
+		return fmt.Sprintf("in deny group %q", r.DeniedBy)
+	case DENIED_BY_REQUIRED_GROUP:
+		return "in none of the required groups"
+	case DENIED_BY_EMAIL_DOMAIN:
+		return fmt.Sprintf("email domain %q is not allowed", r.DeniedBy)
+	case DENIED_BY_RULE:
+		return fmt.Sprintf("denied by rule %q", r.DeniedBy)
+	case DENIED_BY_NO_GRANTS:
+		return "no groups or rules grant access"
+	}
+
+	return ""
+}
+
+// Resolve returns the grants of a user from the groups claim and from the
+// rules evaluated over every claim. The deny groups, required groups and
+// allowed email domains are checked first, and the default grants apply when
+// the groups and rules grant nothing.
+func (a Authz) Resolve(claims map[string]interface{}) Resolution {
+	resolution := Resolution{Groups: Groups{}}
+	userGroups := ClaimValues(claims, "groups")
+
+	if group, ok := matchAny(userGroups, a.DenyGroups, a.patterns); ok {
+		resolution.Denied, resolution.DeniedBy = DENIED_BY_GROUP, group
+		return resolution
+	}
+
+	if _, ok := matchAny(userGroups, a.RequiredGroups, a.patterns); len(a.RequiredGroups) > 0 && !ok {
+		resolution.Denied = DENIED_BY_REQUIRED_GROUP
+		return resolution
+	}
+
+	if domain, ok := a.emailDomainAllowed(claims); !ok {
+		resolution.Denied, resolution.DeniedBy = DENIED_BY_EMAIL_DOMAIN, domain
+		return resolution
+	}
+
+	decision := a.Rules.Evaluate(claims)
+	resolution.Rules = decision.Matched
+
+	if decision.DeniedBy != "" {
+		resolution.Denied, resolution.DeniedBy = DENIED_BY_RULE, decision.DeniedBy
+		return resolution
+	}
+
+	if !decision.Final {
+		resolution.Groups = a.Groups.userGroups(userGroups, a.patterns)
+	}
+
+	for name, group := range decision.Groups {
+		resolution.Groups[rulePrefix+name] = group
+	}
+
+	if len(resolution.Groups) > 0 || a.DefaultGrants.IsZero() {
+		return resolution
+	}
+
+	if a.DefaultGrants.NoAccess {
+		resolution.Denied = DENIED_BY_NO_GRANTS
+		return resolution
+	}
+
+	resolution.Default = true
+	resolution.Groups[defaultGroup] = Group{Orgs: a.DefaultGrants.Orgs, Teams: a.DefaultGrants.Teams}
+
+	return resolution
+}
+
+// emailDomainAllowed returns the domain of the email claim and whether it is
+// one of the allowed email domains. Every domain is allowed when there are
+// none.
+func (a Authz) emailDomainAllowed(claims map[string]interface{}) (string, bool) {
+	if len(a.AllowedEmailDomains) == 0 {
+		return "", true
+	}
+
+	var domain string
+	if emails := ClaimValues(claims, "email"); len(emails) > 0 {
+		if i := strings.LastIndex(emails[0], "@"); i >= 0 {
+			domain = emails[0][i+1:]
+		}
+	}
+
+	for _, allowed := range a.AllowedEmailDomains {
+		if domain != "" && strings.EqualFold(domain, allowed) {
+			return domain, true
+		}
+	}
+
+	return domain, false
+}
+
+// matchAny returns the first of userGroups that is one of groups or matches
+// one of its patterns.
+func matchAny(userGroups, groups []string, compiled groupPatterns) (string, bool) {
+	for _, userGroup := range userGroups {
+		for _, group := range groups {
+			if !IsGroupPattern(group) {
+				if userGroup == group {
+					return userGroup, true
+				}
+				continue
+			}
+
+			// invalid patterns are reported by Validate
+			re, err := compiled.get(group)
+			if err == nil && re.MatchString(userGroup) {
+				return userGroup, true
+			}
+		}
+	}
+
+	return "", false
+}
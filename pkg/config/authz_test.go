@@ -0,0 +1,235 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthzResolve(t *testing.T) {
+	authz := Authz{
+		Groups: Groups{
+			"foo": {Orgs: []Org{{ID: 1, Role: "Editor"}}},
+		},
+		Rules: Rules{
+			{
+				Name: "blocked",
+				When: []Condition{{Claim: "email", Equals: "blocked@example.com"}},
+				Deny: true,
+			},
+			{
+				Name:  "contractors",
+				When:  []Condition{{Claim: "email", Matches: `@contractor\.com$`}},
+				Final: true,
+				Orgs:  []Org{{ID: 1, Role: "Viewer"}},
+			},
+			{
+				Name: "ops",
+				When: []Condition{{Claim: "groups", Equals: "ops"}},
+				Orgs: []Org{{ID: 2, Role: "Admin"}},
+			},
+		},
+	}
+	assert.NoError(t, authz.Validate())
+
+	resolution := authz.Resolve(map[string]interface{}{
+		"email":  "jdoe@example.com",
+		"groups": []interface{}{"foo", "ops"},
+	})
+	assert.Equal(t, Resolution{
+		Groups: Groups{
+			"foo":      {Orgs: []Org{{ID: 1, Role: "Editor"}}},
+			"rule:ops": {Orgs: []Org{{ID: 2, Role: "Admin"}}},
+		},
+		Rules: []string{"ops"},
+	}, resolution)
+
+	resolution = authz.Resolve(map[string]interface{}{
+		"email":  "jdoe@contractor.com",
+		"groups": []interface{}{"foo", "ops"},
+	})
+	assert.Equal(t, Groups{"rule:contractors": {Orgs: []Org{{ID: 1, Role: "Viewer"}}}}, resolution.Groups)
+
+	resolution = authz.Resolve(map[string]interface{}{
+		"email":  "blocked@example.com",
+		"groups": []interface{}{"foo"},
+	})
+	assert.Equal(t, Resolution{Groups: Groups{}, Rules: []string{"blocked"}, Denied: DENIED_BY_RULE, DeniedBy: "blocked"}, resolution)
+	assert.Equal(t, `denied by rule "blocked"`, resolution.Denial())
+}
+
+func TestAuthzRestrictions(t *testing.T) {
+	authz := Authz{
+		Groups:              Groups{"foo": {Orgs: []Org{{ID: 1, Role: "Editor"}}}},
+		DenyGroups:          []string{"blocked", "re:^ex-"},
+		RequiredGroups:      []string{"foo", "team-*"},
+		AllowedEmailDomains: []string{"example.com"},
+	}
+	assert.NoError(t, authz.Validate())
+
+	tests := []struct {
+		groups   []interface{}
+		email    string
+		denied   string
+		deniedBy string
+		denial   string
+	}{
+		{groups: []interface{}{"foo"}, email: "jdoe@Example.com"},
+		{groups: []interface{}{"team-a"}, email: "jdoe@example.com"},
+		{
+			groups:   []interface{}{"foo", "blocked"},
+			email:    "jdoe@example.com",
+			denied:   DENIED_BY_GROUP,
+			deniedBy: "blocked",
+			denial:   `in deny group "blocked"`,
+		},
+		{
+			groups:   []interface{}{"foo", "ex-employees"},
+			email:    "jdoe@example.com",
+			denied:   DENIED_BY_GROUP,
+			deniedBy: "ex-employees",
+			denial:   `in deny group "ex-employees"`,
+		},
+		{
+			groups: []interface{}{"bar"},
+			email:  "jdoe@example.com",
+			denied: DENIED_BY_REQUIRED_GROUP,
+			denial: "in none of the required groups",
+		},
+		{
+			groups:   []interface{}{"foo"},
+			email:    "jdoe@example.com.evil.com",
+			denied:   DENIED_BY_EMAIL_DOMAIN,
+			deniedBy: "example.com.evil.com",
+			denial:   `email domain "example.com.evil.com" is not allowed`,
+		},
+		{
+			groups: []interface{}{"foo"},
+			denied: DENIED_BY_EMAIL_DOMAIN,
+			denial: `email domain "" is not allowed`,
+		},
+	}
+
+	for _, test := range tests {
+		resolution := authz.Resolve(map[string]interface{}{"groups": test.groups, "email": test.email})
+		assert.Equal(t, test.denied, resolution.Denied, test.groups)
+		assert.Equal(t, test.deniedBy, resolution.DeniedBy, test.groups)
+		assert.Equal(t, test.denial, resolution.Denial(), test.groups)
+
+		// denied users get nothing
+		if test.denied != "" {
+			assert.Empty(t, resolution.Groups)
+		}
+	}
+
+	authz = Authz{
+		DenyGroups:          []string{"re:("},
+		RequiredGroups:      []string{"foo"},
+		AllowedEmailDomains: []string{"@example.com", ""},
+	}
+	assert.EqualError(t, authz.Validate(), "denyGroups 0: error parsing regexp: missing closing ): `(`\n"+
+		`allowedEmailDomains 0: "@example.com" is not a domain`+"\n"+
+		`allowedEmailDomains 1: "" is not a domain`)
+}
+
+func TestAuthzDefaultGrants(t *testing.T) {
+	authz := Authz{
+		Groups: Groups{"foo": {Orgs: []Org{{ID: 1, Role: "Editor"}}}},
+		Rules: Rules{
+			{
+				Name:         "admins",
+				When:         []Condition{{Claim: "groups", Equals: "admins"}},
+				GrafanaAdmin: true,
+			},
+		},
+		DefaultGrants: DefaultGrants{
+			Orgs:  []Org{{ID: 2, Role: "Viewer"}},
+			Teams: []Team{{OrgID: 2, Name: "newcomers"}},
+		},
+	}
+	assert.NoError(t, authz.Validate())
+
+	// the default grants only apply when nothing else is granted
+	resolution := authz.Resolve(map[string]interface{}{"groups": []interface{}{"bar"}})
+	assert.True(t, resolution.Default)
+	assert.Equal(t, Groups{defaultGroup: {
+		Orgs:  []Org{{ID: 2, Role: "Viewer"}},
+		Teams: []Team{{OrgID: 2, Name: "newcomers"}},
+	}}, resolution.Groups)
+
+	resolution = authz.Resolve(map[string]interface{}{"groups": []interface{}{"foo"}})
+	assert.False(t, resolution.Default)
+	assert.Equal(t, Groups{"foo": {Orgs: []Org{{ID: 1, Role: "Editor"}}}}, resolution.Groups)
+
+	resolution = authz.Resolve(map[string]interface{}{"groups": []interface{}{"admins"}})
+	assert.False(t, resolution.Default)
+	assert.True(t, resolution.Groups["rule:admins"].GrafanaAdmin)
+	assert.Len(t, resolution.Groups, 1)
+
+	// users without grants are denied
+	authz.DefaultGrants = DefaultGrants{NoAccess: true}
+	assert.NoError(t, authz.Validate())
+
+	resolution = authz.Resolve(map[string]interface{}{"groups": []interface{}{"bar"}})
+	assert.Equal(t, DENIED_BY_NO_GRANTS, resolution.Denied)
+	assert.Equal(t, "no groups or rules grant access", resolution.Denial())
+	assert.Empty(t, resolution.Groups)
+
+	resolution = authz.Resolve(map[string]interface{}{"groups": []interface{}{"foo"}})
+	assert.Empty(t, resolution.Denied)
+
+	// Grafana's default org and role are used without default grants
+	authz.DefaultGrants = DefaultGrants{}
+	resolution = authz.Resolve(map[string]interface{}{"groups": []interface{}{"bar"}})
+	assert.Empty(t, resolution.Denied)
+	assert.False(t, resolution.Default)
+	assert.Empty(t, resolution.Groups)
+
+	authz.DefaultGrants = DefaultGrants{NoAccess: true, Orgs: []Org{{ID: 0, Role: "Owner"}}}
+	assert.EqualError(t, authz.Validate(), "defaultGrants: noAccess can't be set with orgs or teams")
+
+	authz.DefaultGrants = DefaultGrants{Orgs: []Org{{ID: 0, Role: "Owner"}}}
+	assert.EqualError(t, authz.Validate(), "defaultGrants: org 0: id must be greater than 0\n"+
+		`defaultGrants: org 0: role "Owner" is not valid, valid roles are Viewer, Editor or Admin`)
+}
+
+func TestAuthzValidateCompilesPatterns(t *testing.T) {
+	newAuthz := func() Authz {
+		return Authz{
+			Groups: Groups{
+				"team-*-admins": {Orgs: []Org{{Name: "$1", Role: "Admin"}}},
+				"foo":           {Orgs: []Org{{ID: 1, Role: "Viewer"}}},
+			},
+			DenyGroups:     []string{"re:^contractors-"},
+			RequiredGroups: []string{"employees", "team-*"},
+		}
+	}
+
+	authz := newAuthz()
+	assert.NoError(t, authz.Validate())
+	assert.ElementsMatch(t, []string{"team-*-admins", "re:^contractors-", "team-*"}, keys(authz.patterns))
+
+	resolution := authz.Resolve(map[string]interface{}{"groups": []interface{}{"team-a-admins"}})
+	assert.Equal(t, Groups{"team-a-admins": {Orgs: []Org{{Name: "a", Role: "Admin"}}}}, resolution.Groups)
+
+	// the same config validated again is equal, so a reload can tell it
+	// didn't change
+	other := newAuthz()
+	assert.NoError(t, other.Validate())
+	assert.True(t, reflect.DeepEqual(authz, other))
+
+	// patterns that were not compiled by Validate are compiled on use
+	unvalidated := newAuthz()
+	resolution = unvalidated.Resolve(map[string]interface{}{"groups": []interface{}{"contractors-b"}})
+	assert.Equal(t, DENIED_BY_GROUP, resolution.Denied)
+}
+
+func keys(patterns groupPatterns) []string {
+	var keys []string
+	for key := range patterns {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
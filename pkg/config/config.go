@@ -1,27 +1,139 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// validRoles are the org roles Grafana accepts, they match grafana.RoleType.
+var validRoles = map[string]bool{
+	"Viewer": true,
+	"Editor": true,
+	"Admin":  true,
+}
+
 type Group struct {
-	GrafanaAdmin bool  `json:"grafanaAdmin,omitempty"`
-	Orgs         []Org `json:"orgs"`
+	GrafanaAdmin bool   `json:"grafanaAdmin,omitempty"`
+	Orgs         []Org  `json:"orgs"`
+	Teams        []Team `json:"teams,omitempty"`
 }
 
 type Groups map[string]Group
 
+// Org is a role in a Grafana org, identified by ID or by name.
 type Org struct {
-	ID   int64  `json:"id"`
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
 	Role string `json:"role"`
 }
 
+// Team is an existing Grafana team in an org, identified by ID or by name.
+type Team struct {
+	OrgID   int64  `json:"orgId,omitempty"`
+	OrgName string `json:"orgName,omitempty"`
+	Name    string `json:"name"`
+}
+
 // UserGroupsInConfig matches the user groups (from claims) that are
-// present in config and returns a filtered set of Groups
+// present in config and returns a filtered set of Groups, by user group.
+// A user group listed in config uses its own mapping, otherwise it gets the
+// grants of every pattern that matches it, with their captures expanded.
 func ValidUserGroups(userGroups []string, groups Groups) Groups {
+	return groups.userGroups(userGroups, nil)
+}
+
+// userGroups is ValidUserGroups with the patterns compiled by Validate.
+func (g Groups) userGroups(userGroups []string, compiled groupPatterns) Groups {
 	finalGroups := make(map[string]Group)
+	patterns := g.patterns()
 
 	for _, userGroup := range userGroups {
-		if _, ok := groups[userGroup]; ok {
-			finalGroups[userGroup] = groups[userGroup]
+		if group, ok := g[userGroup]; ok && !IsGroupPattern(userGroup) {
+			finalGroups[userGroup] = group
+			continue
+		}
+
+		if group, ok := g.matchPatterns(patterns, compiled, userGroup); ok {
+			finalGroups[userGroup] = group
 		}
 	}
 
 	return finalGroups
 }
+
+// Validate checks that every org of every group has a valid ID or name and
+// role, and is listed once, and that every team has a name and an org. All
+// the problems found are returned joined in a single error.
+func (g Groups) Validate() error {
+	return g.validate(groupPatterns{})
+}
+
+// validate is Validate, it adds the keys that are patterns to compiled.
+func (g Groups) validate(compiled groupPatterns) error {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		pattern := IsGroupPattern(name)
+		if pattern {
+			re, err := compileGroupPattern(name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("group %q: %w", name, err))
+			} else {
+				compiled[name] = re
+			}
+		}
+
+		for _, problem := range validateGrants(g[name].Orgs, g[name].Teams, pattern) {
+			errs = append(errs, fmt.Errorf("group %q: %s", name, problem))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateGrants returns the problems of orgs and teams. Roles can use
+// captures when templates is set.
+func validateGrants(orgs []Org, teams []Team, templates bool) []string {
+	var problems []string
+
+	seenIDs := make(map[int64]bool)
+	seenNames := make(map[string]bool)
+	for i, org := range orgs {
+		switch {
+		case org.Name != "" && org.ID != 0:
+			problems = append(problems, fmt.Sprintf("org %d: id and name can't be set together", i))
+		case org.Name != "":
+			if seenNames[org.Name] {
+				problems = append(problems, fmt.Sprintf("org %d: org name %q is listed more than once", i, org.Name))
+			}
+			seenNames[org.Name] = true
+		case org.ID < 1:
+			problems = append(problems, fmt.Sprintf("org %d: id must be greater than 0", i))
+		case seenIDs[org.ID]:
+			problems = append(problems, fmt.Sprintf("org %d: org id %d is listed more than once", i, org.ID))
+		}
+		seenIDs[org.ID] = true
+
+		if !validRoles[org.Role] && !(templates && isTemplate(org.Role)) {
+			problems = append(problems, fmt.Sprintf("org %d: role %q is not valid, valid roles are Viewer, Editor or Admin", i, org.Role))
+		}
+	}
+
+	for i, team := range teams {
+		if team.Name == "" {
+			problems = append(problems, fmt.Sprintf("team %d: name is required", i))
+		}
+
+		if (team.OrgID == 0) == (team.OrgName == "") {
+			problems = append(problems, fmt.Sprintf("team %d: either orgId or orgName is required", i))
+		}
+	}
+
+	return problems
+}
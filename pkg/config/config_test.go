@@ -46,3 +46,32 @@ func TestValidUserGroups(t *testing.T) {
 	validGroups := ValidUserGroups(userGroups, groups)
 	assert.Equal(t, expectedGroups, validGroups)
 }
+
+func TestGroupsValidate(t *testing.T) {
+	assert.NoError(t, Groups{}.Validate())
+
+	groups := Groups{
+		"two": {
+			Orgs: []Org{
+				{ID: 1, Role: "Editor"},
+				{ID: 0, Role: "editor"},
+			},
+		},
+		"one": {
+			GrafanaAdmin: true,
+		},
+		"three": {
+			Orgs: []Org{
+				{Name: "Main", Role: "Viewer"},
+				{ID: 1, Name: "Main", Role: "Viewer"},
+			},
+			Teams: []Team{{OrgID: 1}},
+		},
+	}
+
+	err := groups.Validate()
+	assert.EqualError(t, err, `group "three": org 1: id and name can't be set together
+group "three": team 0: name is required
+group "two": org 1: id must be greater than 0
+group "two": org 1: role "editor" is not valid, valid roles are Viewer, Editor or Admin`)
+}
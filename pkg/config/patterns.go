@@ -0,0 +1,183 @@
+package config
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// regexpPrefix marks a group key as a regular expression.
+const regexpPrefix = "re:"
+
+// IsGroupPattern reports whether a group key is a pattern matched against
+// the groups of the users instead of a group name. Keys starting with "re:"
+// are regular expressions, and keys with * or ? are globs where * matches
+// any text and ? a single character.
+func IsGroupPattern(key string) bool {
+	return strings.HasPrefix(key, regexpPrefix) || strings.ContainsAny(key, "*?")
+}
+
+// compileGroupPattern returns the regular expression of a group key that is
+// a pattern. Every wildcard of a glob is a capture group.
+func compileGroupPattern(key string) (*regexp.Regexp, error) {
+	expr, ok := strings.CutPrefix(key, regexpPrefix)
+	if !ok {
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range key {
+			switch r {
+			case '*':
+				b.WriteString("(.*)")
+			case '?':
+				b.WriteString("(.)")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	return regexp.Compile(expr)
+}
+
+// groupPatterns are compiled group patterns by key, so they are compiled once
+// per config instead of on every login.
+type groupPatterns map[string]*regexp.Regexp
+
+// get returns the compiled pattern of key, compiling it when it is missing.
+func (p groupPatterns) get(key string) (*regexp.Regexp, error) {
+	if re, ok := p[key]; ok {
+		return re, nil
+	}
+
+	return compileGroupPattern(key)
+}
+
+// patterns returns the keys of g that are patterns, sorted.
+func (g Groups) patterns() []string {
+	var keys []string
+	for key := range g {
+		if IsGroupPattern(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// matchPatterns returns the grants of every pattern of g that matches
+// userGroup, with the captures expanded. The grants are combined in the
+// order of patterns, so the result doesn't depend on the order of the map.
+func (g Groups) matchPatterns(patterns []string, compiled groupPatterns, userGroup string) (Group, bool) {
+	var group Group
+	matched := false
+
+	for _, key := range patterns {
+		re, err := compiled.get(key)
+		if err != nil {
+			// invalid patterns are reported by Validate
+			continue
+		}
+
+		submatches := re.FindStringSubmatch(userGroup)
+		if submatches == nil {
+			continue
+		}
+
+		pattern := g[key]
+		orgs, teams := expandGrants(pattern.Orgs, pattern.Teams, []map[string]string{capture(re, submatches)})
+
+		matched = true
+		group.GrafanaAdmin = group.GrafanaAdmin || pattern.GrafanaAdmin
+		group.Orgs = append(group.Orgs, orgs...)
+		group.Teams = append(group.Teams, teams...)
+	}
+
+	if matched && group.Orgs == nil {
+		group.Orgs = []Org{}
+	}
+
+	return group, matched
+}
+
+// capture returns the capture groups of a match by number and by name.
+func capture(re *regexp.Regexp, submatches []string) map[string]string {
+	capture := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+
+		capture[strconv.Itoa(i)] = submatches[i]
+		if name != "" {
+			capture[name] = submatches[i]
+		}
+	}
+
+	return capture
+}
+
+// expandGrants returns orgs and teams with the captures expanded in their
+// names and roles, once for every combination of captures. Roles are matched
+// case-insensitively, so a capture of "editor" is the role Editor. Orgs and
+// teams whose names expand to nothing, or whose roles are not valid, are
+// skipped.
+func expandGrants(orgs []Org, teams []Team, combinations []map[string]string) ([]Org, []Team) {
+	expandedOrgs := []Org{}
+	var expandedTeams []Team
+
+	for _, captures := range combinations {
+		expand := func(s string) string {
+			return os.Expand(s, func(key string) string { return captures[key] })
+		}
+
+		for _, org := range orgs {
+			if org.Name != "" {
+				if org.Name = expand(org.Name); org.Name == "" {
+					continue
+				}
+			}
+
+			role, ok := canonicalRole(expand(org.Role))
+			if !ok {
+				continue
+			}
+			org.Role = role
+
+			expandedOrgs = append(expandedOrgs, org)
+		}
+
+		for _, team := range teams {
+			team.Name = expand(team.Name)
+			if team.OrgName != "" {
+				team.OrgName = expand(team.OrgName)
+			}
+			if team.Name == "" || (team.OrgID == 0 && team.OrgName == "") {
+				continue
+			}
+			expandedTeams = append(expandedTeams, team)
+		}
+	}
+
+	return expandedOrgs, expandedTeams
+}
+
+// canonicalRole returns the valid role that matches role case-insensitively.
+func canonicalRole(role string) (string, bool) {
+	for valid := range validRoles {
+		if strings.EqualFold(valid, role) {
+			return valid, true
+		}
+	}
+
+	return "", false
+}
+
+// isTemplate reports whether s uses captures.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "$")
+}
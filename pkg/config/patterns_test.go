@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidUserGroupsPatterns(t *testing.T) {
+	groups := Groups{
+		"grafana-org-*-*": {
+			Orgs: []Org{{Name: "$1", Role: "$2"}},
+		},
+		`re:^grafana-org-(?P<org>[a-z]+)-admin$`: {
+			Orgs:  []Org{{Name: "${org}", Role: "Admin"}},
+			Teams: []Team{{OrgName: "${org}", Name: "${org}-admins"}},
+		},
+		"grafana-org-payments-*": {
+			Orgs: []Org{{ID: 2, Role: "Viewer"}},
+		},
+		"grafana-org-billing-editor": {
+			Orgs: []Org{{ID: 3, Role: "Editor"}},
+		},
+		"ops-?": {
+			GrafanaAdmin: true,
+		},
+	}
+	assert.NoError(t, groups.Validate())
+
+	validGroups := ValidUserGroups([]string{
+		"grafana-org-search-editor",
+		"grafana-org-search-admin",
+		"grafana-org-payments-admin",
+		"grafana-org-billing-editor",
+		"grafana-org-search-owner",
+		"ops-1",
+		"ops-12",
+		"other",
+	}, groups)
+
+	assert.Equal(t, Groups{
+		// roles are matched case-insensitively
+		"grafana-org-search-editor": {Orgs: []Org{{Name: "search", Role: "Editor"}}},
+		// every pattern that matches grants its orgs, in the order of the
+		// patterns
+		"grafana-org-search-admin": {
+			Orgs:  []Org{{Name: "search", Role: "Admin"}, {Name: "search", Role: "Admin"}},
+			Teams: []Team{{OrgName: "search", Name: "search-admins"}},
+		},
+		"grafana-org-payments-admin": {
+			Orgs: []Org{
+				{Name: "payments", Role: "Admin"},
+				{ID: 2, Role: "Viewer"},
+				{Name: "payments", Role: "Admin"},
+			},
+			Teams: []Team{{OrgName: "payments", Name: "payments-admins"}},
+		},
+		// a group listed in config is used before the patterns
+		"grafana-org-billing-editor": {Orgs: []Org{{ID: 3, Role: "Editor"}}},
+		// a role that is not valid is skipped
+		"grafana-org-search-owner": {Orgs: []Org{}},
+		"ops-1":                    {GrafanaAdmin: true, Orgs: []Org{}},
+	}, validGroups)
+}
+
+func TestGroupPatternsValidate(t *testing.T) {
+	groups := Groups{
+		"re:(":   {Orgs: []Org{{ID: 1, Role: "Viewer"}}},
+		"foo":    {Orgs: []Org{{ID: 1, Role: "$1"}}},
+		"foo-*":  {Orgs: []Org{{Name: "$1", Role: "$2"}}},
+		"re:foo": {Orgs: []Org{{ID: 1, Role: "editor"}}},
+	}
+
+	err := groups.Validate()
+	assert.EqualError(t, err, `group "foo": org 0: role "$1" is not valid, valid roles are Viewer, Editor or Admin
+group "re:(": error parsing regexp: missing closing ): `+"`(`"+`
+group "re:foo": org 0: role "editor" is not valid, valid roles are Viewer, Editor or Admin`)
+}
@@ -0,0 +1,283 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule grants org roles, the Grafana admin flag and teams to the users whose
+// claims match all its conditions, or denies their login. A rule without
+// conditions matches every user.
+//
+// The capture groups of the matched conditions can be used in the names of
+// orgs and teams, and in roles, as $1 or ${name}. A rule grants its orgs and
+// teams for every value of the claims that matches, so a user in the groups
+// team-a-admins and team-b-admins can be made Admin of the orgs team-a and
+// team-b by a single rule.
+type Rule struct {
+	Name string      `json:"name,omitempty"`
+	When []Condition `json:"when,omitempty"`
+	// Deny rejects the login of the users that match.
+	Deny bool `json:"deny,omitempty"`
+	// Final replaces every grant of the groups and of the previous rules
+	// with the grants of the rule, and stops the evaluation.
+	Final        bool   `json:"final,omitempty"`
+	GrafanaAdmin bool   `json:"grafanaAdmin,omitempty"`
+	Orgs         []Org  `json:"orgs,omitempty"`
+	Teams        []Team `json:"teams,omitempty"`
+}
+
+// Condition matches a claim of the token. Nested claims are separated by
+// dots, like realm_access.roles. A claim with several values, like groups,
+// matches when any of its values matches. Without Equals or Matches the
+// condition checks that the claim is present and not empty.
+type Condition struct {
+	Claim   string `json:"claim"`
+	Equals  string `json:"equals,omitempty"`
+	Matches string `json:"matches,omitempty"`
+	// Not negates the condition.
+	Not bool `json:"not,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Rules are evaluated in order.
+type Rules []Rule
+
+// Decision is the outcome of the rules for a user.
+type Decision struct {
+	// Groups has the grants of the rules that matched, by rule name.
+	Groups Groups
+	// Matched are the names of the rules that matched, in order.
+	Matched []string
+	// DeniedBy is the name of the rule that denied the login.
+	DeniedBy string
+	// Final is set when a final rule matched.
+	Final bool
+}
+
+// Validate checks the conditions and grants of every rule and compiles their
+// regular expressions. All the problems found are returned joined in a
+// single error.
+func (r Rules) Validate() error {
+	var errs []error
+	for i := range r {
+		rule := &r[i]
+		name := rule.name(i)
+
+		for j := range rule.When {
+			condition := &rule.When[j]
+
+			if condition.Claim == "" {
+				errs = append(errs, fmt.Errorf("rule %q: condition %d: claim is required", name, j))
+			}
+
+			if condition.Equals != "" && condition.Matches != "" {
+				errs = append(errs, fmt.Errorf("rule %q: condition %d: equals and matches can't be set together", name, j))
+			}
+
+			if condition.Matches != "" {
+				re, err := regexp.Compile(condition.Matches)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("rule %q: condition %d: %w", name, j, err))
+					continue
+				}
+				condition.re = re
+			}
+		}
+
+		hasGrants := rule.GrafanaAdmin || len(rule.Orgs) > 0 || len(rule.Teams) > 0
+		switch {
+		case rule.Deny && (hasGrants || rule.Final):
+			errs = append(errs, fmt.Errorf("rule %q: a deny rule can't grant anything or be final", name))
+		case !rule.Deny && !rule.Final && !hasGrants:
+			errs = append(errs, fmt.Errorf("rule %q: grants nothing, set orgs, teams, grafanaAdmin, deny or final", name))
+		}
+
+		for _, problem := range validateGrants(rule.Orgs, rule.Teams, true) {
+			errs = append(errs, fmt.Errorf("rule %q: %s", name, problem))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Evaluate evaluates the rules in order over claims. The evaluation stops at
+// the first deny or final rule that matches.
+func (r Rules) Evaluate(claims map[string]interface{}) Decision {
+	decision := Decision{Groups: Groups{}}
+
+	for i, rule := range r {
+		captures, ok := rule.match(claims)
+		if !ok {
+			continue
+		}
+
+		name := rule.name(i)
+		decision.Matched = append(decision.Matched, name)
+
+		if rule.Deny {
+			decision.DeniedBy = name
+			decision.Groups = Groups{}
+			return decision
+		}
+
+		if rule.Final {
+			decision.Final = true
+			decision.Groups = Groups{name: rule.grant(captures)}
+			return decision
+		}
+
+		decision.Groups[name] = rule.grant(captures)
+	}
+
+	return decision
+}
+
+// name returns the name of the rule, or its position when it has none.
+func (r Rule) name(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return "#" + strconv.Itoa(i+1)
+}
+
+// match reports whether claims match every condition, and returns the
+// combinations of the captures of the matched conditions.
+func (r Rule) match(claims map[string]interface{}) ([]map[string]string, bool) {
+	combinations := []map[string]string{{}}
+
+	for _, condition := range r.When {
+		captures, ok := condition.match(claims)
+		if !ok {
+			return nil, false
+		}
+
+		if len(captures) == 0 {
+			continue
+		}
+
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, capture := range captures {
+				merged := make(map[string]string, len(combination)+len(capture))
+				for k, v := range combination {
+					merged[k] = v
+				}
+				for k, v := range capture {
+					merged[k] = v
+				}
+				next = append(next, merged)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations, true
+}
+
+// grant returns the grants of the rule with the captures expanded in the
+// names and roles of orgs and teams for every combination of captures.
+func (r Rule) grant(combinations []map[string]string) Group {
+	orgs, teams := expandGrants(r.Orgs, r.Teams, combinations)
+
+	return Group{GrafanaAdmin: r.GrafanaAdmin, Orgs: orgs, Teams: teams}
+}
+
+// match reports whether the condition matches claims, and returns the
+// captures of every value that matches a regular expression.
+func (c Condition) match(claims map[string]interface{}) ([]map[string]string, bool) {
+	values := ClaimValues(claims, c.Claim)
+
+	var captures []map[string]string
+	matched := false
+
+	switch {
+	case c.Matches != "":
+		re := c.re
+		if re == nil {
+			// rules that were not validated
+			var err error
+			if re, err = regexp.Compile(c.Matches); err != nil {
+				return nil, c.Not
+			}
+		}
+
+		for _, value := range values {
+			submatches := re.FindStringSubmatch(value)
+			if submatches == nil {
+				continue
+			}
+
+			matched = true
+			captures = append(captures, capture(re, submatches))
+		}
+	case c.Equals != "":
+		for _, value := range values {
+			if value == c.Equals {
+				matched = true
+			}
+		}
+	default:
+		matched = len(values) > 0
+	}
+
+	if c.Not {
+		// a negated condition doesn't capture anything
+		return nil, !matched
+	}
+
+	return captures, matched
+}
+
+// ClaimValues returns the values of a claim as strings. Nested claims are
+// separated by dots. Lists return a value per element, and empty values are
+// skipped.
+func ClaimValues(claims map[string]interface{}, claim string) []string {
+	var value interface{} = claims
+	for _, key := range strings.Split(claim, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		if value, ok = m[key]; !ok {
+			return nil
+		}
+	}
+
+	var values []string
+	add := func(v interface{}) {
+		switch v := v.(type) {
+		case nil, map[string]interface{}, []interface{}:
+		case string:
+			if v != "" {
+				values = append(values, v)
+			}
+		case float64:
+			// JSON numbers, without the exponent of large ones
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			add(item)
+		}
+	case []string:
+		for _, item := range v {
+			add(item)
+		}
+	default:
+		add(v)
+	}
+
+	return values
+}
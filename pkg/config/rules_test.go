@@ -0,0 +1,111 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulesEvaluate(t *testing.T) {
+	rules := Rules{
+		{
+			Name: "mfa",
+			When: []Condition{{Claim: "acr", Equals: "mfa", Not: true}},
+			Deny: true,
+		},
+		{
+			Name: "team admins",
+			When: []Condition{{Claim: "groups", Matches: `^team-(?P<team>.*)-admins$`}},
+			Orgs: []Org{{Name: "$1", Role: "Admin"}},
+			Teams: []Team{
+				{OrgName: "${team}", Name: "${team}-admins"},
+			},
+		},
+		{
+			When:         []Condition{{Claim: "realm_access.roles", Equals: "grafana-admin"}},
+			GrafanaAdmin: true,
+		},
+		{
+			Name:  "contractors",
+			When:  []Condition{{Claim: "email", Matches: `@contractor\.com$`}},
+			Final: true,
+			Orgs:  []Org{{ID: 1, Role: "Viewer"}},
+		},
+	}
+	assert.NoError(t, rules.Validate())
+
+	decision := rules.Evaluate(map[string]interface{}{"sub": "jdoe"})
+	assert.Equal(t, Decision{Groups: Groups{}, Matched: []string{"mfa"}, DeniedBy: "mfa"}, decision)
+
+	decision = rules.Evaluate(map[string]interface{}{
+		"acr":          "mfa",
+		"email":        "jdoe@example.com",
+		"groups":       []interface{}{"team-a-admins", "team-b-admins", "other"},
+		"realm_access": map[string]interface{}{"roles": []interface{}{"grafana-admin"}},
+	})
+	assert.Equal(t, Decision{
+		Groups: Groups{
+			"team admins": {
+				Orgs: []Org{{Name: "a", Role: "Admin"}, {Name: "b", Role: "Admin"}},
+				Teams: []Team{
+					{OrgName: "a", Name: "a-admins"},
+					{OrgName: "b", Name: "b-admins"},
+				},
+			},
+			"#3": {GrafanaAdmin: true, Orgs: []Org{}},
+		},
+		Matched: []string{"team admins", "#3"},
+	}, decision)
+
+	// a final rule replaces the grants of the previous rules
+	decision = rules.Evaluate(map[string]interface{}{
+		"acr":    "mfa",
+		"email":  "jdoe@contractor.com",
+		"groups": []interface{}{"team-a-admins"},
+	})
+	assert.Equal(t, Decision{
+		Groups:  Groups{"contractors": {Orgs: []Org{{ID: 1, Role: "Viewer"}}}},
+		Matched: []string{"team admins", "contractors"},
+		Final:   true,
+	}, decision)
+}
+
+func TestRulesValidate(t *testing.T) {
+	assert.NoError(t, Rules{}.Validate())
+
+	rules := Rules{
+		{
+			When: []Condition{{Equals: "foo", Matches: "("}},
+			Orgs: []Org{{ID: 1, Role: "Viewer"}},
+		},
+		{Name: "nothing"},
+		{Name: "deny", Deny: true, Teams: []Team{{Name: "ops"}}},
+	}
+
+	err := rules.Validate()
+	assert.EqualError(t, err, "rule \"#1\": condition 0: claim is required\n"+
+		"rule \"#1\": condition 0: equals and matches can't be set together\n"+
+		"rule \"#1\": condition 0: error parsing regexp: missing closing ): `(`\n"+
+		"rule \"nothing\": grants nothing, set orgs, teams, grafanaAdmin, deny or final\n"+
+		"rule \"deny\": a deny rule can't grant anything or be final\n"+
+		"rule \"deny\": team 0: either orgId or orgName is required")
+}
+
+func TestClaimValues(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":          "jdoe",
+		"email":        "",
+		"exp":          float64(1700000000),
+		"groups":       []interface{}{"foo", "", "bar"},
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+	}
+
+	assert.Equal(t, []string{"jdoe"}, ClaimValues(claims, "sub"))
+	assert.Nil(t, ClaimValues(claims, "email"))
+	assert.Equal(t, []string{"1700000000"}, ClaimValues(claims, "exp"))
+	assert.Equal(t, []string{"foo", "bar"}, ClaimValues(claims, "groups"))
+	assert.Equal(t, []string{"admin"}, ClaimValues(claims, "realm_access.roles"))
+	assert.Nil(t, ClaimValues(claims, "realm_access"))
+	assert.Nil(t, ClaimValues(claims, "sub.name"))
+	assert.Nil(t, ClaimValues(claims, "missing"))
+}
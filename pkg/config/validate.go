@@ -0,0 +1,624 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an issue found in a config file. Line is 0 when the problem
+// can't be tied to a line.
+type Problem struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Path != "" {
+		fmt.Fprintf(&b, "%s: ", p.Path)
+	}
+	b.WriteString(p.Message)
+
+	return b.String()
+}
+
+// Problems is returned as an error when a config file is not valid.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Parse strictly reads the groups, rules, login restrictions and default
+// grants of a YAML, or JSON, config file. Anchors, aliases and merge keys are
+// resolved first. Every other top level key must be in settings, unless
+// settings is nil. All the problems found are returned as Problems.
+func Parse(data []byte, settings map[string]bool) (Authz, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Authz{}, Problems{{Message: err.Error()}}
+	}
+
+	authz := Authz{Groups: Groups{}}
+	// an empty file is a valid config without groups
+	if len(doc.Content) == 0 {
+		return authz, nil
+	}
+
+	p := &parser{}
+	root := p.resolve(doc.Content[0], map[*yaml.Node]bool{})
+	if root.Kind != yaml.MappingNode {
+		return Authz{}, Problems{{Line: root.Line, Message: "config must be a mapping of settings"}}
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		// settings are case-insensitive
+		name := strings.ToLower(key.Value)
+		if line, ok := seen[name]; ok {
+			p.add(key, key.Value, "setting is already defined on line %d", line)
+			continue
+		}
+		seen[name] = key.Line
+
+		switch {
+		case name == "groups":
+			authz.Groups = p.groups(value)
+		case name == "rules":
+			authz.Rules = p.rules(value)
+		case name == "denygroups":
+			authz.DenyGroups = p.groupList(value, key.Value)
+		case name == "requiredgroups":
+			authz.RequiredGroups = p.groupList(value, key.Value)
+		case name == "allowedemaildomains":
+			authz.AllowedEmailDomains = p.domainList(value, key.Value)
+		case name == "defaultgrants":
+			authz.DefaultGrants = p.defaultGrants(value, key.Value)
+		case settings != nil && !settings[name] && value.Anchor == "":
+			// a key with an anchor only holds values for aliases
+			p.add(key, key.Value, "unknown setting")
+		}
+	}
+
+	if len(p.problems) > 0 {
+		return Authz{}, p.problems
+	}
+
+	// compiles the regular expressions of the rules and the group patterns
+	// kept on the config, the parser already reported every problem it can
+	// find
+	if err := authz.Validate(); err != nil {
+		return Authz{}, Problems{{Message: err.Error()}}
+	}
+
+	return authz, nil
+}
+
+type parser struct {
+	problems Problems
+}
+
+func (p *parser) add(node *yaml.Node, path, format string, args ...interface{}) {
+	p.problems = append(p.problems, Problem{
+		Line:    node.Line,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// resolve returns node with its aliases replaced by the nodes they refer to
+// and the merge keys of its mappings expanded, the way decoding it would. The
+// keys of a mapping take precedence over the merged ones, and the first
+// mapping of a merged list over the next ones. The nodes of the document are
+// not modified.
+func (p *parser) resolve(node *yaml.Node, resolving map[*yaml.Node]bool) *yaml.Node {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	// an alias to one of its parents
+	if resolving[node] {
+		p.add(node, "", "an anchor can't refer to itself")
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: node.Line}
+	}
+	resolving[node] = true
+	defer delete(resolving, node)
+
+	switch node.Kind {
+	case yaml.SequenceNode:
+		resolved := *node
+		resolved.Content = make([]*yaml.Node, len(node.Content))
+		for i, item := range node.Content {
+			resolved.Content[i] = p.resolve(item, resolving)
+		}
+
+		return &resolved
+	case yaml.MappingNode:
+		var content, merged []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], p.resolve(node.Content[i+1], resolving)
+			if key.ShortTag() != "!!merge" {
+				content = append(content, key, value)
+				continue
+			}
+
+			sources := []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				sources = value.Content
+			}
+			for _, source := range sources {
+				if source.Kind != yaml.MappingNode {
+					p.add(source, key.Value, "must be a mapping or a list of mappings to merge")
+					continue
+				}
+				merged = append(merged, source.Content...)
+			}
+		}
+
+		keys := make(map[string]bool)
+		for i := 0; i < len(content); i += 2 {
+			keys[content[i].Value] = true
+		}
+		for i := 0; i+1 < len(merged); i += 2 {
+			if !keys[merged[i].Value] {
+				keys[merged[i].Value] = true
+				content = append(content, merged[i], merged[i+1])
+			}
+		}
+
+		resolved := *node
+		resolved.Content = content
+
+		return &resolved
+	}
+
+	return node
+}
+
+func (p *parser) groups(node *yaml.Node) Groups {
+	groups := Groups{}
+
+	if node.Kind != yaml.MappingNode {
+		// a key without a value is the same as no groups
+		if node.Tag != "!!null" {
+			p.add(node, "groups", "must be a mapping of group names")
+		}
+		return groups
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := "groups." + key.Value
+
+		if line, ok := seen[key.Value]; ok {
+			p.add(key, path, "group is already defined on line %d", line)
+			continue
+		}
+		seen[key.Value] = key.Line
+
+		pattern := IsGroupPattern(key.Value)
+		if pattern {
+			if _, err := compileGroupPattern(key.Value); err != nil {
+				p.add(key, path, "%s", err)
+			}
+		}
+
+		groups[key.Value] = p.group(value, path, pattern)
+	}
+
+	return groups
+}
+
+// group parses a group, its roles can use captures when templates is set.
+func (p *parser) group(node *yaml.Node, path string, templates bool) Group {
+	group := Group{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with grafanaAdmin, orgs and teams")
+		return group
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		// keys used to be matched case-insensitively
+		switch {
+		case strings.EqualFold(key.Value, "grafanaAdmin"):
+			group.GrafanaAdmin = p.bool(value, path+"."+key.Value)
+		case strings.EqualFold(key.Value, "orgs"):
+			group.Orgs = p.orgs(value, path+"."+key.Value, templates)
+		case strings.EqualFold(key.Value, "teams"):
+			group.Teams = p.teams(value, path+"."+key.Value)
+		default:
+			p.add(key, path+"."+key.Value, "unknown field, valid fields are grafanaAdmin, orgs and teams")
+		}
+	}
+
+	return group
+}
+
+func (p *parser) defaultGrants(node *yaml.Node, path string) DefaultGrants {
+	grants := DefaultGrants{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with noAccess, orgs and teams")
+		return grants
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch {
+		case strings.EqualFold(key.Value, "noAccess"):
+			grants.NoAccess = p.bool(value, path+"."+key.Value)
+		case strings.EqualFold(key.Value, "orgs"):
+			grants.Orgs = p.orgs(value, path+"."+key.Value, false)
+		case strings.EqualFold(key.Value, "teams"):
+			grants.Teams = p.teams(value, path+"."+key.Value)
+		default:
+			p.add(key, path+"."+key.Value, "unknown field, valid fields are noAccess, orgs and teams")
+		}
+	}
+
+	switch {
+	case grants.NoAccess && (len(grants.Orgs) > 0 || len(grants.Teams) > 0):
+		p.add(node, path, "noAccess can't be set with orgs or teams")
+	case grants.IsZero():
+		p.add(node, path, "grants nothing, set orgs, teams or noAccess")
+	}
+
+	return grants
+}
+
+func (p *parser) bool(node *yaml.Node, path string) bool {
+	var value bool
+	if err := node.Decode(&value); err != nil {
+		p.add(node, path, "must be true or false")
+	}
+
+	return value
+}
+
+func (p *parser) orgs(node *yaml.Node, path string, templates bool) []Org {
+	if node.Kind != yaml.SequenceNode {
+		p.add(node, path, "must be a list of orgs")
+		return nil
+	}
+
+	orgs := []Org{}
+	seenIDs := make(map[int64]int)
+	seenNames := make(map[string]int)
+
+	for i, item := range node.Content {
+		orgPath := fmt.Sprintf("%s[%d]", path, i)
+
+		org, valid := p.org(item, orgPath, templates)
+
+		if line, ok := seenIDs[org.ID]; ok && org.ID > 0 {
+			p.add(item, orgPath, "org id %d is already listed on line %d", org.ID, line)
+			continue
+		}
+		if line, ok := seenNames[org.Name]; ok && org.Name != "" {
+			p.add(item, orgPath, "org name %q is already listed on line %d", org.Name, line)
+			continue
+		}
+		seenIDs[org.ID] = item.Line
+		seenNames[org.Name] = item.Line
+
+		if valid {
+			orgs = append(orgs, org)
+		}
+	}
+
+	return orgs
+}
+
+func (p *parser) org(node *yaml.Node, path string, templates bool) (Org, bool) {
+	org := Org{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with id or name, and role")
+		return org, false
+	}
+
+	var hasID, hasName, hasRole bool
+	valid := true
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch {
+		case strings.EqualFold(key.Value, "id"):
+			hasID = true
+			if err := value.Decode(&org.ID); err != nil || org.ID < 1 {
+				p.add(value, path+".id", "must be an org id greater than 0")
+				valid = false
+			}
+		case strings.EqualFold(key.Value, "name"):
+			hasName = true
+			org.Name = value.Value
+			if value.Kind != yaml.ScalarNode || org.Name == "" {
+				p.add(value, path+".name", "must be an org name")
+				valid = false
+			}
+		case strings.EqualFold(key.Value, "role"):
+			hasRole = true
+			org.Role = value.Value
+			if value.Kind != yaml.ScalarNode || (!validRoles[org.Role] && !(templates && isTemplate(org.Role))) {
+				p.add(value, path+".role", "role %q is not valid, valid roles are Viewer, Editor or Admin", value.Value)
+				valid = false
+			}
+		default:
+			p.add(key, path+"."+key.Value, "unknown field, valid fields are id, name and role")
+			valid = false
+		}
+	}
+
+	switch {
+	case hasID && hasName:
+		p.add(node, path, "id and name can't be set together")
+		valid = false
+	case !hasID && !hasName:
+		p.add(node, path, "id or name is required")
+		valid = false
+	}
+
+	if !hasRole {
+		p.add(node, path, "role is required")
+		valid = false
+	}
+
+	return org, valid
+}
+
+func (p *parser) teams(node *yaml.Node, path string) []Team {
+	if node.Kind != yaml.SequenceNode {
+		p.add(node, path, "must be a list of teams")
+		return nil
+	}
+
+	teams := []Team{}
+	for i, item := range node.Content {
+		if team, valid := p.team(item, fmt.Sprintf("%s[%d]", path, i)); valid {
+			teams = append(teams, team)
+		}
+	}
+
+	return teams
+}
+
+func (p *parser) team(node *yaml.Node, path string) (Team, bool) {
+	team := Team{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with name, and orgId or orgName")
+		return team, false
+	}
+
+	valid := true
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch {
+		case strings.EqualFold(key.Value, "name"):
+			team.Name = value.Value
+		case strings.EqualFold(key.Value, "orgId"):
+			if err := value.Decode(&team.OrgID); err != nil || team.OrgID < 1 {
+				p.add(value, path+"."+key.Value, "must be an org id greater than 0")
+				valid = false
+			}
+		case strings.EqualFold(key.Value, "orgName"):
+			team.OrgName = value.Value
+		default:
+			p.add(key, path+"."+key.Value, "unknown field, valid fields are name, orgId and orgName")
+			valid = false
+		}
+	}
+
+	if team.Name == "" {
+		p.add(node, path, "name is required")
+		valid = false
+	}
+
+	if valid && (team.OrgID == 0) == (team.OrgName == "") {
+		p.add(node, path, "either orgId or orgName is required")
+		valid = false
+	}
+
+	return team, valid
+}
+
+// stringList parses a list of strings, or a key without a value. check
+// returns the problem of a value, if any.
+func (p *parser) stringList(node *yaml.Node, path string, check func(string) string) []string {
+	if node.Kind != yaml.SequenceNode {
+		if node.Tag != "!!null" {
+			p.add(node, path, "must be a list")
+		}
+		return nil
+	}
+
+	values := []string{}
+	for i, item := range node.Content {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if item.Kind != yaml.ScalarNode || item.Value == "" {
+			p.add(item, itemPath, "must be a non empty string")
+			continue
+		}
+
+		if problem := check(item.Value); problem != "" {
+			p.add(item, itemPath, "%s", problem)
+		}
+		values = append(values, item.Value)
+	}
+
+	return values
+}
+
+// groupList parses a list of group names or patterns.
+func (p *parser) groupList(node *yaml.Node, path string) []string {
+	return p.stringList(node, path, func(group string) string {
+		if !IsGroupPattern(group) {
+			return ""
+		}
+
+		if _, err := compileGroupPattern(group); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+}
+
+// domainList parses a list of email domains.
+func (p *parser) domainList(node *yaml.Node, path string) []string {
+	return p.stringList(node, path, func(domain string) string {
+		if strings.Contains(domain, "@") {
+			return fmt.Sprintf("%q is not a domain, remove the @", domain)
+		}
+		return ""
+	})
+}
+
+func (p *parser) rules(node *yaml.Node) Rules {
+	if node.Kind != yaml.SequenceNode {
+		// a key without a value is the same as no rules
+		if node.Tag != "!!null" {
+			p.add(node, "rules", "must be a list of rules")
+		}
+		return nil
+	}
+
+	rules := Rules{}
+	seen := make(map[string]int)
+	for i, item := range node.Content {
+		path := fmt.Sprintf("rules[%d]", i)
+
+		rule := p.rule(item, path)
+		if line, ok := seen[rule.Name]; ok && rule.Name != "" {
+			p.add(item, path, "rule %q is already defined on line %d", rule.Name, line)
+		}
+		seen[rule.Name] = item.Line
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func (p *parser) rule(node *yaml.Node, path string) Rule {
+	rule := Rule{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with when and what the rule grants")
+		return rule
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		fieldPath := path + "." + key.Value
+
+		switch {
+		case strings.EqualFold(key.Value, "name"):
+			rule.Name = value.Value
+		case strings.EqualFold(key.Value, "when"):
+			rule.When = p.conditions(value, fieldPath)
+		case strings.EqualFold(key.Value, "deny"):
+			rule.Deny = p.bool(value, fieldPath)
+		case strings.EqualFold(key.Value, "final"):
+			rule.Final = p.bool(value, fieldPath)
+		case strings.EqualFold(key.Value, "grafanaAdmin"):
+			rule.GrafanaAdmin = p.bool(value, fieldPath)
+		case strings.EqualFold(key.Value, "orgs"):
+			rule.Orgs = p.orgs(value, fieldPath, true)
+		case strings.EqualFold(key.Value, "teams"):
+			rule.Teams = p.teams(value, fieldPath)
+		default:
+			p.add(key, fieldPath, "unknown field, valid fields are name, when, deny, final, grafanaAdmin, orgs and teams")
+		}
+	}
+
+	hasGrants := rule.GrafanaAdmin || len(rule.Orgs) > 0 || len(rule.Teams) > 0
+	switch {
+	case rule.Deny && (hasGrants || rule.Final):
+		p.add(node, path, "a deny rule can't grant anything or be final")
+	case !rule.Deny && !rule.Final && !hasGrants:
+		p.add(node, path, "grants nothing, set orgs, teams, grafanaAdmin, deny or final")
+	}
+
+	return rule
+}
+
+func (p *parser) conditions(node *yaml.Node, path string) []Condition {
+	if node.Kind != yaml.SequenceNode {
+		p.add(node, path, "must be a list of conditions")
+		return nil
+	}
+
+	conditions := []Condition{}
+	for i, item := range node.Content {
+		if condition, valid := p.condition(item, fmt.Sprintf("%s[%d]", path, i)); valid {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	return conditions
+}
+
+func (p *parser) condition(node *yaml.Node, path string) (Condition, bool) {
+	condition := Condition{}
+
+	if node.Kind != yaml.MappingNode {
+		p.add(node, path, "must be a mapping with claim, and equals or matches")
+		return condition, false
+	}
+
+	valid := true
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch {
+		case strings.EqualFold(key.Value, "claim"):
+			condition.Claim = value.Value
+		case strings.EqualFold(key.Value, "equals"):
+			condition.Equals = value.Value
+		case strings.EqualFold(key.Value, "matches"):
+			condition.Matches = value.Value
+			if _, err := regexp.Compile(condition.Matches); err != nil {
+				p.add(value, path+"."+key.Value, "%s", err)
+				valid = false
+			}
+		case strings.EqualFold(key.Value, "not"):
+			condition.Not = p.bool(value, path+"."+key.Value)
+		default:
+			p.add(key, path+"."+key.Value, "unknown field, valid fields are claim, equals, matches and not")
+			valid = false
+		}
+	}
+
+	if condition.Claim == "" {
+		p.add(node, path, "claim is required")
+		valid = false
+	}
+
+	if condition.Equals != "" && condition.Matches != "" {
+		p.add(node, path, "equals and matches can't be set together")
+		valid = false
+	}
+
+	return condition, valid
+}
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	settings := map[string]bool{"admin-password": true, "log-level": true}
+
+	authz, err := Parse([]byte(`
+admin-password: secret
+groups:
+  foo:
+    grafanaAdmin: true
+    orgs:
+      - id: 1
+        role: Editor
+  bar:
+    grafanaadmin: false
+    orgs:
+      - id: 1
+        role: Viewer
+      - id: 2
+        role: Admin
+      - name: Payments
+        role: Editor
+    teams:
+      - name: payments-oncall
+        orgName: Payments
+rules:
+  - name: mfa
+    when:
+      - claim: acr
+        equals: mfa
+        not: true
+    deny: true
+  - when:
+      - claim: groups
+        matches: ^team-(.*)-admins$
+    orgs:
+      - name: $1
+        role: Admin
+denyGroups:
+  - contractors-*
+requiredGroups: [foo, bar]
+allowedEmailDomains:
+  - example.com
+defaultGrants:
+  orgs:
+    - id: 1
+      role: Viewer
+`), settings)
+	assert.NoError(t, err)
+	assert.Equal(t, Groups{
+		"foo": {GrafanaAdmin: true, Orgs: []Org{{ID: 1, Role: "Editor"}}},
+		"bar": {
+			Orgs:  []Org{{ID: 1, Role: "Viewer"}, {ID: 2, Role: "Admin"}, {Name: "Payments", Role: "Editor"}},
+			Teams: []Team{{OrgName: "Payments", Name: "payments-oncall"}},
+		},
+	}, authz.Groups)
+	assert.Len(t, authz.Rules, 2)
+	assert.Equal(t, "mfa", authz.Rules[0].Name)
+	assert.Equal(t, []Condition{{Claim: "acr", Equals: "mfa", Not: true}}, authz.Rules[0].When)
+	// the regular expressions are compiled
+	assert.NotNil(t, authz.Rules[1].When[0].re)
+	assert.Equal(t, []string{"contractors-*"}, authz.DenyGroups)
+	assert.Equal(t, []string{"foo", "bar"}, authz.RequiredGroups)
+	assert.Equal(t, []string{"example.com"}, authz.AllowedEmailDomains)
+	assert.Equal(t, DefaultGrants{Orgs: []Org{{ID: 1, Role: "Viewer"}}}, authz.DefaultGrants)
+
+	authz, err = Parse([]byte("defaultGrants:\n  noAccess: true\n"), settings)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultGrants{NoAccess: true}, authz.DefaultGrants)
+
+	authz, err = Parse([]byte(""), settings)
+	assert.NoError(t, err)
+	assert.Equal(t, Authz{Groups: Groups{}}, authz)
+
+	authz, err = Parse([]byte("groups:\nrules:\n"), settings)
+	assert.NoError(t, err)
+	assert.Equal(t, Authz{Groups: Groups{}}, authz)
+
+	// anchors, aliases and merge keys are resolved like when decoding, and
+	// keys with an anchor are not settings
+	authz, err = Parse([]byte(`
+viewer: &viewer
+  orgs:
+    - id: 1
+      role: Viewer
+groups:
+  a: &editor
+    grafanaAdmin: false
+    orgs:
+      - id: 2
+        role: Editor
+  b: *editor
+  c:
+    <<: *viewer
+    grafanaAdmin: true
+  d:
+    <<: [*viewer, *editor]
+rules:
+  - &mfa
+    when:
+      - claim: acr
+        equals: mfa
+    orgs: &orgs
+      - name: Payments
+        role: Viewer
+  - <<: *mfa
+    name: admins
+    grafanaAdmin: true
+    orgs: *orgs
+`), settings)
+	assert.NoError(t, err)
+	viewer := []Org{{ID: 1, Role: "Viewer"}}
+	editor := []Org{{ID: 2, Role: "Editor"}}
+	assert.Equal(t, Groups{
+		"a": {Orgs: editor},
+		"b": {Orgs: editor},
+		"c": {GrafanaAdmin: true, Orgs: viewer},
+		"d": {Orgs: viewer},
+	}, authz.Groups)
+	assert.Len(t, authz.Rules, 2)
+	assert.Equal(t, "admins", authz.Rules[1].Name)
+	assert.True(t, authz.Rules[1].GrafanaAdmin)
+	assert.Equal(t, authz.Rules[0].When, authz.Rules[1].When)
+
+	// unknown settings are only rejected when the settings are known
+	_, err = Parse([]byte("unknown: 1\n"), nil)
+	assert.NoError(t, err)
+}
+
+func TestParseCompilesPatterns(t *testing.T) {
+	authz, err := Parse([]byte(`
+groups:
+  team-*-admins:
+    orgs:
+      - name: $1
+        role: Admin
+denyGroups:
+  - re:^contractors-
+requiredGroups:
+  - team-*
+`), nil)
+	assert.NoError(t, err)
+
+	// the patterns are compiled once, not on every resolution
+	assert.ElementsMatch(t, []string{"team-*-admins", "re:^contractors-", "team-*"}, keys(authz.patterns))
+
+	resolution := authz.Resolve(map[string]interface{}{"groups": []interface{}{"team-a-admins"}})
+	assert.Equal(t, Groups{"team-a-admins": {Orgs: []Org{{Name: "a", Role: "Admin"}}}}, resolution.Groups)
+}
+
+func TestParseProblems(t *testing.T) {
+	settings := map[string]bool{"admin-password": true, "log-level": true}
+
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "syntax",
+			config: "groups: [",
+			want:   "yaml: line 1: did not find expected node content",
+		},
+		{
+			name:   "not a mapping",
+			config: "- groups",
+			want:   "line 1: config must be a mapping of settings",
+		},
+		{
+			name:   "unknown and duplicated settings",
+			config: "admin-pasword: secret\nlog-level: info\nLog-Level: debug\n",
+			want: "line 1: admin-pasword: unknown setting\n" +
+				"line 3: Log-Level: setting is already defined on line 2",
+		},
+		{
+			name: "groups",
+			config: `groups:
+  foo:
+    admin: true
+    grafanaAdmin: yes please
+    orgs:
+      - id: 1
+        role: editor
+      - id: 0
+        role: Viewer
+      - id: 2
+        role: Viewer
+      - id: 2
+        role: Admin
+      - role: Admin
+        team: ops
+  bar: []
+  foo:
+    orgs: {}
+`,
+			want: "line 3: groups.foo.admin: unknown field, valid fields are grafanaAdmin, orgs and teams\n" +
+				"line 4: groups.foo.grafanaAdmin: must be true or false\n" +
+				`line 7: groups.foo.orgs[0].role: role "editor" is not valid, valid roles are Viewer, Editor or Admin` + "\n" +
+				"line 8: groups.foo.orgs[1].id: must be an org id greater than 0\n" +
+				"line 12: groups.foo.orgs[3]: org id 2 is already listed on line 10\n" +
+				"line 15: groups.foo.orgs[4].team: unknown field, valid fields are id, name and role\n" +
+				"line 14: groups.foo.orgs[4]: id or name is required\n" +
+				"line 16: groups.bar: must be a mapping with grafanaAdmin, orgs and teams\n" +
+				"line 17: groups.foo: group is already defined on line 2",
+		},
+		{
+			name: "patterns",
+			config: `groups:
+  "re:(":
+    orgs:
+      - id: 1
+        role: Viewer
+  grafana-org-*-*:
+    orgs:
+      - name: $1
+        role: $2
+  foo:
+    orgs:
+      - id: 1
+        role: $1
+`,
+			want: "line 2: groups.re:(: error parsing regexp: missing closing ): `(`\n" +
+				`line 13: groups.foo.orgs[0].role: role "$1" is not valid, valid roles are Viewer, Editor or Admin`,
+		},
+		{
+			name: "orgs and teams",
+			config: `groups:
+  foo:
+    orgs:
+      - id: 1
+        name: Main
+        role: Viewer
+      - name: Payments
+        role: Viewer
+      - name: Payments
+        role: Admin
+    teams:
+      - name: oncall
+      - orgId: 1
+      - name: oncall
+        orgId: 1
+        orgName: Main
+`,
+			want: "line 4: groups.foo.orgs[0]: id and name can't be set together\n" +
+				"line 9: groups.foo.orgs[2]: org name \"Payments\" is already listed on line 7\n" +
+				"line 12: groups.foo.teams[0]: either orgId or orgName is required\n" +
+				"line 13: groups.foo.teams[1]: name is required\n" +
+				"line 14: groups.foo.teams[2]: either orgId or orgName is required",
+		},
+		{
+			name: "rules",
+			config: `rules:
+  - name: one
+    when:
+      - claim: groups
+        equals: foo
+        matches: foo
+      - matches: "("
+    final: maybe
+    orgs:
+      - id: 1
+        role: Viewer
+  - name: one
+    deny: true
+    grafanaAdmin: true
+  - when:
+      - claim: email
+        contains: "@example.com"
+  - name: three
+`,
+			want: "line 4: rules[0].when[0]: equals and matches can't be set together\n" +
+				"line 7: rules[0].when[1].matches: error parsing regexp: missing closing ): `(`\n" +
+				"line 7: rules[0].when[1]: claim is required\n" +
+				"line 8: rules[0].final: must be true or false\n" +
+				"line 12: rules[1]: a deny rule can't grant anything or be final\n" +
+				"line 12: rules[1]: rule \"one\" is already defined on line 2\n" +
+				"line 17: rules[2].when[0].contains: unknown field, valid fields are claim, equals, matches and not\n" +
+				"line 15: rules[2]: grants nothing, set orgs, teams, grafanaAdmin, deny or final\n" +
+				"line 18: rules[3]: grants nothing, set orgs, teams, grafanaAdmin, deny or final",
+		},
+		{
+			name: "restrictions",
+			config: `denyGroups:
+  - "re:("
+  - ""
+requiredGroups: foo
+allowedEmailDomains:
+  - "@example.com"
+  - example.org
+`,
+			want: "line 2: denyGroups[0]: error parsing regexp: missing closing ): `(`\n" +
+				"line 3: denyGroups[1]: must be a non empty string\n" +
+				"line 4: requiredGroups: must be a list\n" +
+				"line 6: allowedEmailDomains[0]: \"@example.com\" is not a domain, remove the @",
+		},
+		{
+			name: "default grants",
+			config: `defaultGrants:
+  noAccess: true
+  orgs:
+    - id: 1
+      role: Viewer
+  groups: []
+`,
+			want: "line 6: defaultGrants.groups: unknown field, valid fields are noAccess, orgs and teams\n" +
+				"line 2: defaultGrants: noAccess can't be set with orgs or teams",
+		},
+		{
+			name: "anchors",
+			config: `groups:
+  a: &a
+    orgs:
+      - id: 0
+        role: Viewer
+  b: *a
+  c:
+    <<: foo
+    orgs: []
+`,
+			want: "line 8: <<: must be a mapping or a list of mappings to merge\n" +
+				"line 4: groups.a.orgs[0].id: must be an org id greater than 0\n" +
+				"line 4: groups.b.orgs[0].id: must be an org id greater than 0",
+		},
+		{
+			name:   "empty default grants",
+			config: "defaultGrants: {}\n",
+			want:   "line 1: defaultGrants: grants nothing, set orgs, teams or noAccess",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.config), settings)
+		assert.EqualError(t, err, test.want, test.name)
+	}
+}
@@ -0,0 +1,112 @@
+package grafana
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned for calls rejected while the circuit breaker
+// is open. RetryAfter is the time left until a call is allowed again.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrCircuitOpen, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// BreakerConfig configures the circuit breaker around Grafana API calls. The
+// breaker opens after Threshold consecutive failed calls and rejects every
+// call for Cooldown. After that a single call is let through and its result
+// closes or re-opens the breaker.
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// WithCircuitBreaker enables the circuit breaker. A Threshold lower than 1
+// disables it.
+func WithCircuitBreaker(cfg BreakerConfig) ClientFuncOpt {
+	return func(c *Client) error {
+		if cfg.Threshold < 1 {
+			c.breaker = nil
+			return nil
+		}
+
+		c.breaker = &circuitBreaker{
+			threshold: cfg.Threshold,
+			cooldown:  cfg.Cooldown,
+			now:       time.Now,
+		}
+
+		return nil
+	}
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// allow returns a CircuitOpenError when the call must not be attempted. A nil
+// breaker allows every call.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+
+	remaining := b.openedAt.Add(b.cooldown).Sub(b.now())
+	if remaining > 0 {
+		return &CircuitOpenError{RetryAfter: remaining}
+	}
+
+	// half-open, only one call probes Grafana at a time
+	if b.probing {
+		return &CircuitOpenError{RetryAfter: b.cooldown}
+	}
+	b.probing = true
+
+	return nil
+}
+
+// record updates the breaker with the result of an allowed call.
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
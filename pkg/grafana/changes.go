@@ -0,0 +1,87 @@
+package grafana
+
+import (
+	"context"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+type ChangeKind string
+
+// Kinds of changes applied to Grafana users
+const (
+	CHANGE_USER_CREATED          ChangeKind = "user_created"
+	CHANGE_ORG_ROLE_ADDED        ChangeKind = "org_role_added"
+	CHANGE_ORG_ROLE_UPDATED      ChangeKind = "org_role_updated"
+	CHANGE_GRAFANA_ADMIN_GRANTED ChangeKind = "grafana_admin_granted"
+	CHANGE_GRAFANA_ADMIN_REVOKED ChangeKind = "grafana_admin_revoked"
+	CHANGE_TEAM_MEMBER_ADDED     ChangeKind = "team_member_added"
+)
+
+// Change is a change applied to a Grafana user. OrgID, OldRole and NewRole
+// are only set for org role changes, OldRole is empty when the user was added
+// to the org. OrgID and Team are set when the user was added to a team.
+type Change struct {
+	Kind    ChangeKind
+	UserID  int64
+	Login   string
+	OrgID   int64
+	OldRole RoleType
+	NewRole RoleType
+	Team    string
+}
+
+// ChangeHandler is called with the context of the operation after a change
+// has been applied, or instead of applying it in dry run.
+type ChangeHandler func(ctx context.Context, change Change)
+
+// WithChangeHandler sets a function that is called for every change applied
+// to Grafana users.
+func WithChangeHandler(handler ChangeHandler) ClientFuncOpt {
+	return func(c *Client) error {
+		c.changeHandler = handler
+		return nil
+	}
+}
+
+// LogChange logs change as a structured event with the fields of the
+// change. It is meant to be used as a ChangeHandler in dry run, to review the
+// changes before they are applied.
+func LogChange(ctx context.Context, change Change) {
+	fields := log.Fields{
+		"change":  change.Kind,
+		"user_id": change.UserID,
+	}
+	if change.Login != "" {
+		fields["grafana_login"] = change.Login
+	}
+	switch {
+	case change.Team != "":
+		fields["org_id"] = change.OrgID
+		fields["team"] = change.Team
+	case change.OrgID != 0:
+		fields["org_id"] = change.OrgID
+		fields["old_role"] = change.OldRole
+		fields["new_role"] = change.NewRole
+	}
+
+	logging.FromContext(ctx).WithFields(fields).Info("Grafana change not applied in dry run")
+}
+
+// recordChange counts change in the metrics and passes it to the change
+// handler.
+func (c *Client) recordChange(ctx context.Context, change Change) {
+	// the metrics only count changes that were applied
+	switch {
+	case c.dryRun:
+	case change.Kind == CHANGE_USER_CREATED:
+		c.metrics.usersCreated.Inc()
+	default:
+		c.metrics.roleChanges.WithLabelValues(string(change.Kind)).Inc()
+	}
+
+	if c.changeHandler != nil {
+		c.changeHandler(ctx, change)
+	}
+}
@@ -0,0 +1,54 @@
+package grafana
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogChange(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	ctx := logging.NewContext(context.Background(), log.Fields{"request_id": "1"})
+
+	LogChange(ctx, Change{Kind: CHANGE_USER_CREATED, Login: "foo"})
+	assert.Equal(t, log.Fields{
+		"request_id":    "1",
+		"change":        CHANGE_USER_CREATED,
+		"user_id":       int64(0),
+		"grafana_login": "foo",
+	}, hook.LastEntry().Data)
+
+	LogChange(ctx, Change{Kind: CHANGE_ORG_ROLE_UPDATED, UserID: 1, Login: "foo", OrgID: 2, OldRole: ROLE_VIEWER, NewRole: ROLE_ADMIN})
+	assert.Equal(t, log.Fields{
+		"request_id":    "1",
+		"change":        CHANGE_ORG_ROLE_UPDATED,
+		"user_id":       int64(1),
+		"grafana_login": "foo",
+		"org_id":        int64(2),
+		"old_role":      ROLE_VIEWER,
+		"new_role":      ROLE_ADMIN,
+	}, hook.LastEntry().Data)
+
+	LogChange(ctx, Change{Kind: CHANGE_TEAM_MEMBER_ADDED, UserID: 1, Login: "foo", OrgID: 2, Team: "oncall"})
+	assert.Equal(t, log.Fields{
+		"request_id":    "1",
+		"change":        CHANGE_TEAM_MEMBER_ADDED,
+		"user_id":       int64(1),
+		"grafana_login": "foo",
+		"org_id":        int64(2),
+		"team":          "oncall",
+	}, hook.LastEntry().Data)
+
+	LogChange(ctx, Change{Kind: CHANGE_GRAFANA_ADMIN_GRANTED, UserID: 1})
+	assert.Equal(t, log.Fields{
+		"request_id": "1",
+		"change":     CHANGE_GRAFANA_ADMIN_GRANTED,
+		"user_id":    int64(1),
+	}, hook.LastEntry().Data)
+}
@@ -1,14 +1,19 @@
 package grafana
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
 	"github.com/kanopy-platform/k8s-auth-portal/pkg/random"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -16,6 +21,19 @@ var (
 	ErrRoleNotValid         = errors.New("role is not valid")
 	ErrUserNotFound         = errors.New("user not found")
 	ErrOrgUserAlreadyMember = errors.New("user is already member of this organization")
+	ErrLookupNotValid       = errors.New("lookup strategy is not valid")
+	ErrUserIdentityMismatch = errors.New("existing user login and email do not match the token claims")
+)
+
+type LookupStrategy string
+
+// Strategies used to find an existing Grafana user from the token claims.
+// Grafana resolves a lookup against both the login and email columns, so the
+// strategy decides which claim value is sent.
+const (
+	LOOKUP_LOGIN            LookupStrategy = "login"
+	LOOKUP_EMAIL            LookupStrategy = "email"
+	LOOKUP_LOGIN_THEN_EMAIL LookupStrategy = "login-then-email"
 )
 
 type RoleType string
@@ -30,59 +48,156 @@ const (
 type userOrgsRoleMap map[int64]RoleType
 
 type Client struct {
-	client GAPIClient
+	client          GAPIClient
+	skipProfileSync bool
+	lookupStrategy  LookupStrategy
+	retry           RetryConfig
+	breaker         *circuitBreaker
+	metrics         *metrics
+	changeHandler   ChangeHandler
+	dryRun          bool
 }
 
+type ClientFuncOpt func(*Client) error
+
 type GAPIClient interface {
 	UserByEmail(email string) (user gapi.User, err error)
 	CreateUser(user gapi.User) (int64, error)
 	AddOrgUser(orgID int64, user, role string) error
 	UpdateOrgUser(orgID, userID int64, role string) error
+	UserOrgs(userID int64) ([]UserOrg, error)
 	UpdateUserPermissions(id int64, isAdmin bool) error
+	UserUpdate(user gapi.User) error
+	Health() (gapi.HealthResponse, error)
+	Orgs() ([]gapi.Org, error)
+	OrgByName(name string) (gapi.Org, error)
+	SearchOrgTeam(orgID int64, query string) ([]*gapi.Team, error)
+	OrgTeamMembers(orgID, teamID int64) ([]*gapi.TeamMember, error)
+	AddOrgTeamMember(orgID, teamID, userID int64) error
 }
 
-func NewClient(baseURL *url.URL, cfg gapi.Config) (*Client, error) {
-	newClient := &Client{}
+// WithoutUserProfileSync disables updating the Name and Email of existing
+// users when they differ from the values in the token claims.
+func WithoutUserProfileSync() ClientFuncOpt {
+	return func(c *Client) error {
+		c.skipProfileSync = true
+		return nil
+	}
+}
+
+// WithDryRun makes the client read users and roles from Grafana but never
+// change them. The changes that would have been applied are still passed to
+// the change handler, users that would have been created have ID 0.
+func WithDryRun() ClientFuncOpt {
+	return func(c *Client) error {
+		c.dryRun = true
+		return nil
+	}
+}
+
+// WithLookupStrategy sets how existing users are found. Defaults to
+// LOOKUP_LOGIN_THEN_EMAIL.
+func WithLookupStrategy(strategy LookupStrategy) ClientFuncOpt {
+	return func(c *Client) error {
+		switch strategy {
+		case LOOKUP_LOGIN, LOOKUP_EMAIL, LOOKUP_LOGIN_THEN_EMAIL:
+			c.lookupStrategy = strategy
+			return nil
+		}
+
+		return fmt.Errorf("%w: %q", ErrLookupNotValid, strategy)
+	}
+}
+
+func NewClient(baseURL *url.URL, cfg gapi.Config, opts ...ClientFuncOpt) (*Client, error) {
+	newClient := &Client{
+		lookupStrategy: LOOKUP_LOGIN_THEN_EMAIL,
+		metrics:        newMetrics(),
+	}
 
 	if baseURL == nil {
 		return nil, ErrInvalidURL
 	}
 
+	for _, opt := range opts {
+		if err := opt(newClient); err != nil {
+			return nil, err
+		}
+	}
+
 	client, err := gapi.New(baseURL.String(), cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	newClient.client = client
+	newClient.client = gapiClient{Client: client, baseURL: *baseURL, config: cfg}
 
 	return newClient, nil
 }
 
 // LookupUser search for a user by Login or Email and returns it
-func (c *Client) LookupUser(loginOrEmail string) (gapi.User, error) {
-	user, err := c.client.UserByEmail(loginOrEmail)
+func (c *Client) LookupUser(ctx context.Context, loginOrEmail string) (user gapi.User, err error) {
+	ctx, end := c.instrument(ctx, "LookupUser")
+	defer func() { end(err) }()
+
+	err = c.call(ctx, true, func() error {
+		var err error
+		user, err = c.client.UserByEmail(loginOrEmail)
+		return newAPIError(err, statusErrors{http.StatusNotFound: ErrUserNotFound})
+	})
 	if err != nil {
-
-		// the error message is longer but given that this is constrained
-		// to a returned message from an specific call, it's better to keep it short
-		if !strings.Contains(strings.ToLower(err.Error()), ErrUserNotFound.Error()) {
+		if !errors.Is(err, ErrUserNotFound) {
 			return user, err
 		}
+
+		return gapi.User{}, nil
 	}
 
 	return user, nil
 }
 
+// FindUser looks up an existing user using the configured lookup strategy.
+// An empty user is returned when no user is found.
+func (c *Client) FindUser(ctx context.Context, login, email string) (user gapi.User, err error) {
+	ctx, end := startSpan(ctx, "FindUser", attribute.String("grafana.lookup_strategy", string(c.lookupStrategy)))
+	defer func() { end(err) }()
+
+	switch c.lookupStrategy {
+	case LOOKUP_EMAIL:
+		return c.lookupNonEmpty(ctx, email)
+	case LOOKUP_LOGIN:
+		return c.lookupNonEmpty(ctx, login)
+	}
+
+	user, err = c.lookupNonEmpty(ctx, login)
+	// the email is not looked up again when it is the login, which is the
+	// default claims mapping
+	if err != nil || user.Login != "" || email == login {
+		return user, err
+	}
+
+	return c.lookupNonEmpty(ctx, email)
+}
+
+func (c *Client) lookupNonEmpty(ctx context.Context, loginOrEmail string) (gapi.User, error) {
+	if loginOrEmail == "" {
+		return gapi.User{}, nil
+	}
+
+	return c.LookupUser(ctx, loginOrEmail)
+}
+
 // CreateUser adds a new global user to Grafana
-func (c *Client) CreateUser(user gapi.User) (int64, error) {
-	var uid int64
+func (c *Client) CreateUser(ctx context.Context, user gapi.User) (uid int64, err error) {
+	ctx, end := c.instrument(ctx, "CreateUser")
+	defer func() { end(err) }()
 
 	// The Grafana API requires a password for user creation
 	if user.Password == "" {
 		// Generate new random password
 		passwd, err := random.SecureString(12)
 		if err != nil {
-			log.Errorf("error generating random password: %v", err)
+			logging.FromContext(ctx).WithError(err).Error("error generating random password")
 
 			return uid, err
 		}
@@ -90,61 +205,247 @@ func (c *Client) CreateUser(user gapi.User) (int64, error) {
 		user.Password = passwd
 	}
 
-	uid, err := c.client.CreateUser(user)
+	if c.dryRun {
+		c.recordChange(ctx, Change{Kind: CHANGE_USER_CREATED, Login: user.Login})
+		return 0, nil
+	}
+
+	// creating a user is not idempotent so it is never retried
+	err = c.call(ctx, false, func() error {
+		var err error
+		uid, err = c.client.CreateUser(user)
+		return newAPIError(err, nil)
+	})
 	if err != nil {
 		return uid, err
 	}
 
+	c.recordChange(ctx, Change{Kind: CHANGE_USER_CREATED, UserID: uid, Login: user.Login})
+
 	return uid, nil
 }
 
 // AddOrgUser adds a user, with a role, to an Organization specified by OrgID
-func (c *Client) AddOrgUser(OrgID int64, login string, role string) error {
-	err := c.client.AddOrgUser(OrgID, login, role)
-	if err != nil {
-		return err
-	}
-
-	return nil
+func (c *Client) AddOrgUser(ctx context.Context, OrgID int64, login string, role string) (err error) {
+	ctx, end := startSpan(ctx, "AddOrgUser", attribute.Int64("grafana.org_id", OrgID), attribute.String("grafana.role", role))
+	defer func() { end(err) }()
+
+	// a repeated add is answered with a conflict, which UpsertOrgUser handles,
+	// so it is safe to retry
+	err = c.call(ctx, true, func() error {
+		return newAPIError(c.client.AddOrgUser(OrgID, login, role), statusErrors{
+			http.StatusNotFound: ErrUserNotFound,
+			http.StatusConflict: ErrOrgUserAlreadyMember,
+		})
+	})
+
+	return err
 }
 
 // UpsertOrgUser adds a user to an Organization if not present or
-// updates the user role if already a member.
-func (c *Client) UpsertOrgUser(orgID int64, user gapi.User, role string) error {
+// updates the user role if already a member and the role changed.
+func (c *Client) UpsertOrgUser(ctx context.Context, orgID int64, user gapi.User, role string) error {
+	return c.upsertOrgUser(ctx, orgID, user, role, nil)
+}
+
+// upsertOrgUser is UpsertOrgUser with the current roles of the user, as
+// returned by userOrgRoles. When they are nil they are only looked up if the
+// user is already a member of the org.
+func (c *Client) upsertOrgUser(ctx context.Context, orgID int64, user gapi.User, role string, currentRoles map[int64]RoleType) (err error) {
+	ctx, end := c.instrument(ctx, "UpsertOrgUser", attribute.Int64("grafana.org_id", orgID), attribute.String("grafana.role", role))
+	defer func() { end(err) }()
+
+	if c.dryRun {
+		return c.planOrgUser(ctx, orgID, user, role, currentRoles)
+	}
+
+	oldRole, isMember := currentRoles[orgID]
+	if !isMember {
+		err = c.AddOrgUser(ctx, orgID, user.Login, role)
+		if err == nil {
+			c.recordChange(ctx, Change{
+				Kind:    CHANGE_ORG_ROLE_ADDED,
+				UserID:  user.ID,
+				Login:   user.Login,
+				OrgID:   orgID,
+				NewRole: RoleType(role),
+			})
+
+			return nil
+		}
+
+		if !errors.Is(err, ErrOrgUserAlreadyMember) {
+			return err
+		}
+
+		// the user is already a member, the role is only updated when it
+		// changed
+		currentRoles, err = c.userOrgRoles(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		oldRole = currentRoles[orgID]
+	}
 
-	var isOrgMember bool
+	if oldRole == RoleType(role) {
+		return nil
+	}
 
-	err := c.AddOrgUser(orgID, user.Login, role)
+	err = c.call(ctx, true, func() error {
+		return newAPIError(c.client.UpdateOrgUser(orgID, user.ID, role), nil)
+	})
 	if err != nil {
+		return err
+	}
+
+	c.recordChange(ctx, Change{
+		Kind:    CHANGE_ORG_ROLE_UPDATED,
+		UserID:  user.ID,
+		Login:   user.Login,
+		OrgID:   orgID,
+		OldRole: oldRole,
+		NewRole: RoleType(role),
+	})
+
+	return nil
+}
 
-		if !strings.Contains(strings.ToLower(err.Error()), ErrOrgUserAlreadyMember.Error()) {
+// planOrgUser records the change UpsertOrgUser would apply without applying
+// it.
+func (c *Client) planOrgUser(ctx context.Context, orgID int64, user gapi.User, role string, currentRoles map[int64]RoleType) error {
+	// a user that would have been created is not a member of any org
+	if currentRoles == nil && user.ID != 0 {
+		var err error
+		currentRoles, err = c.userOrgRoles(ctx, user.ID)
+		if err != nil {
 			return err
-		} else {
-			isOrgMember = true
 		}
 	}
+	oldRole := currentRoles[orgID]
+
+	change := Change{
+		Kind:    CHANGE_ORG_ROLE_ADDED,
+		UserID:  user.ID,
+		Login:   user.Login,
+		OrgID:   orgID,
+		OldRole: oldRole,
+		NewRole: RoleType(role),
+	}
+
+	switch oldRole {
+	case RoleType(role):
+		return nil
+	case "":
+	default:
+		change.Kind = CHANGE_ORG_ROLE_UPDATED
+	}
+
+	c.recordChange(ctx, change)
+
+	return nil
+}
+
+func (c *Client) UpdateUserPermissions(ctx context.Context, id int64, isAdmin bool) (err error) {
+	ctx, end := c.instrument(ctx, "UpdateUserPermissions", attribute.Bool("grafana.admin", isAdmin))
+	defer func() { end(err) }()
 
-	// Always update user even if it's a member as the roles might have changed.
-	if isOrgMember {
-		err = c.client.UpdateOrgUser(orgID, user.ID, role)
+	if !c.dryRun {
+		err = c.call(ctx, true, func() error {
+			return newAPIError(c.client.UpdateUserPermissions(id, isAdmin), statusErrors{http.StatusNotFound: ErrUserNotFound})
+		})
 		if err != nil {
 			return err
 		}
 	}
 
+	change := Change{Kind: CHANGE_GRAFANA_ADMIN_REVOKED, UserID: id}
+	if isAdmin {
+		change.Kind = CHANGE_GRAFANA_ADMIN_GRANTED
+	}
+	c.recordChange(ctx, change)
+
+	return nil
+}
+
+// Health checks that Grafana is up and can reach its database. It doesn't
+// need credentials. Health checks bypass retries and the circuit breaker so
+// they always report the current state of Grafana, and give up when ctx is
+// done.
+func (c *Client) Health(ctx context.Context) (err error) {
+	_, end := startSpan(ctx, "Health")
+	defer func() { end(err) }()
+
+	var health gapi.HealthResponse
+	err = withContext(ctx, func() (err error) {
+		health, err = c.client.Health()
+		return err
+	})
+	if err != nil {
+		return newAPIError(err, nil)
+	}
+
+	if health.Database != "ok" {
+		return fmt.Errorf("grafana database is %q", health.Database)
+	}
+
 	return nil
 }
 
-func (c *Client) UpdateUserPermissions(id int64, isAdmin bool) error {
-	return c.client.UpdateUserPermissions(id, isAdmin)
+// CheckAdminAccess checks that the configured credentials are valid and have
+// the Grafana admin permissions the proxy needs.
+func (c *Client) CheckAdminAccess(ctx context.Context) (err error) {
+	_, end := startSpan(ctx, "CheckAdminAccess")
+	defer func() { end(err) }()
+
+	err = withContext(ctx, func() error {
+		_, err := c.client.Orgs()
+		return err
+	})
+	return newAPIError(err, nil)
+}
+
+// withContext runs fn until it returns or ctx is done, whichever comes first.
+// The gapi client doesn't take a context, so a call stalled on Grafana is left
+// running in the background and its result is discarded.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("grafana didn't answer in time: %w", ctx.Err())
+	}
 }
 
 // UpdateOrgUserAuthz updates both roles and global admin status for a user
 // taking into account group configuration. It outputs a mapping of role-in-org
 // it will return an error when there's an issue updating the GrafanaAdmin permissions
-func (c *Client) UpdateOrgUserAuthz(user gapi.User, groups config.Groups) (userOrgsRoleMap, error) {
+func (c *Client) UpdateOrgUserAuthz(ctx context.Context, user gapi.User, groups config.Groups) (_ userOrgsRoleMap, err error) {
+	ctx, end := startSpan(ctx, "UpdateOrgUserAuthz")
+	defer func() { end(err) }()
+
+	userOrgsRole, isGlobalAdmin := ResolveOrgRoles(groups)
+
+	// only update global admin value if it's different to what the user already have
+	if user.IsAdmin != isGlobalAdmin {
+		err = c.UpdateUserPermissions(ctx, user.ID, isGlobalAdmin)
+		if err != nil {
+			return userOrgsRole, err
+		}
+	}
+
+	return userOrgsRole, nil
+}
+
+// ResolveOrgRoles returns the role per org and the Grafana admin flag granted
+// by groups. A user in several groups gets the most permissive role of each
+// org, and is Grafana admin when any of the groups grants it. Orgs referenced
+// by name are left out, see ResolveNamedOrgRoles.
+func ResolveOrgRoles(groups config.Groups) (map[int64]RoleType, bool) {
 	// Mapping of role per org
-	userOrgsRole := make(userOrgsRoleMap)
+	userOrgsRole := make(map[int64]RoleType)
 	var isGlobalAdmin bool
 
 	for _, group := range groups {
@@ -152,51 +453,195 @@ func (c *Client) UpdateOrgUserAuthz(user gapi.User, groups config.Groups) (userO
 		isGlobalAdmin = isGlobalAdmin || group.GrafanaAdmin
 
 		for _, org := range group.Orgs {
-			// Check if the users has a more permissive role and apply that instead
-			if !isRoleAssignable(userOrgsRole[org.ID], RoleType(org.Role)) {
+			// orgs referenced by a name that was not resolved
+			if org.ID == 0 {
 				continue
 			}
 
-			userOrgsRole[org.ID] = RoleType(org.Role)
+			assignRole(userOrgsRole, org.ID, RoleType(org.Role))
 		}
 	}
 
-	// only update global admin value if it's different to what the user already have
-	if user.IsAdmin != isGlobalAdmin {
-		err := c.UpdateUserPermissions(user.ID, isGlobalAdmin)
+	return userOrgsRole, isGlobalAdmin
+}
+
+// ResolveNamedOrgRoles returns the role per org name granted by the orgs of
+// groups that are referenced by name, the same way ResolveOrgRoles does.
+func ResolveNamedOrgRoles(groups config.Groups) map[string]RoleType {
+	userOrgsRole := make(map[string]RoleType)
+
+	for _, group := range groups {
+		for _, org := range group.Orgs {
+			if org.Name != "" {
+				assignRole(userOrgsRole, org.Name, RoleType(org.Role))
+			}
+		}
+	}
+
+	return userOrgsRole
+}
+
+// assignRole sets the role of org in roles unless it already has a more
+// permissive one.
+func assignRole[K comparable](roles map[K]RoleType, org K, role RoleType) {
+	// Check if the users has a more permissive role and apply that instead
+	if isRoleAssignable(roles[org], role) {
+		roles[org] = role
+	}
+}
+
+// SyncUser makes sure the user exists in Grafana and that its Grafana admin
+// flag and roles per org match groups, and adds it to the teams of groups. It
+// returns the user and the role per org it should have. A role or team that
+// can't be updated doesn't fail the sync, as the user still gets Grafana's
+// default org and role.
+func (c *Client) SyncUser(ctx context.Context, login, name, email string, groups config.Groups) (gapi.User, map[int64]RoleType, error) {
+	groups, err := c.resolveOrgNames(ctx, groups)
+	if err != nil {
+		return gapi.User{}, nil, fmt.Errorf("error resolving org names: %w", err)
+	}
+
+	user, err := c.GetOrCreateUser(ctx, login, name, email)
+	if err != nil {
+		return gapi.User{}, nil, fmt.Errorf("error obtaining or creating user: %w", err)
+	}
+
+	userOrgsRole, err := c.UpdateOrgUserAuthz(ctx, user, groups)
+	if err != nil {
+		return gapi.User{}, nil, fmt.Errorf("error updating global Grafana admin permissions: %w", err)
+	}
+
+	// the current roles are looked up once, so the orgs where the role didn't
+	// change cost no other call
+	var currentRoles map[int64]RoleType
+	if len(userOrgsRole) > 0 && user.ID != 0 {
+		currentRoles, err = c.userOrgRoles(ctx, user.ID)
 		if err != nil {
-			return userOrgsRole, err
+			logging.FromContext(ctx).WithError(err).Warn("failed to look up the current org roles")
 		}
 	}
 
-	return userOrgsRole, nil
+	for orgID, role := range userOrgsRole {
+		err = c.upsertOrgUser(ctx, orgID, user, string(role), currentRoles)
+		if err != nil {
+			// if an upsert fails we still allow the user to login as it will be assigned to
+			// the configured default Org and Role
+			logging.FromContext(ctx).WithError(err).WithFields(log.Fields{
+				"org_id": orgID,
+				"role":   role,
+			}).Warn("failed to update org role")
+		}
+	}
+
+	c.syncTeams(ctx, user, groups)
+
+	return user, userOrgsRole, nil
 }
 
-func (c *Client) GetOrCreateUser(login, name, email string) (gapi.User, error) {
+func (c *Client) GetOrCreateUser(ctx context.Context, login, name, email string) (user gapi.User, err error) {
+	ctx, end := startSpan(ctx, "GetOrCreateUser")
+	defer func() { end(err) }()
+
 	// lookup the user globally first as if it is not present it would need to
 	// be created
-	user, err := c.LookupUser(login)
+	user, err = c.FindUser(ctx, login, email)
 	if err != nil {
 		return user, err
 	}
 
+	if user.Login != "" && !isSameIdentity(user, login, email) {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"login":         login,
+			"email":         email,
+			"grafana_id":    user.ID,
+			"grafana_login": user.Login,
+			"grafana_email": user.Email,
+		}).Warn("refusing to link token to an existing user with a different login and email")
+
+		return gapi.User{}, ErrUserIdentityMismatch
+	}
+
 	// if the Login field in user is empty, it means that the user wasn't found
 	if user.Login == "" {
 		user.Login = login
 		user.Name = name
 		user.Email = email
 
-		uid, err := c.CreateUser(user)
+		user.ID, err = c.CreateUser(ctx, user)
 		if err != nil {
 			return gapi.User{}, err
 		}
 
-		user.ID = uid
+		return user, nil
+	}
+
+	if !c.skipProfileSync {
+		// the profile is best-effort, e.g. the email can be taken by another
+		// user, and must not deny the login
+		synced, err := c.SyncUserProfile(ctx, user, name, email)
+		if err != nil {
+			logging.FromContext(ctx).WithError(err).WithField("grafana_login", user.Login).Warn("failed to update user profile")
+			return user, nil
+		}
+		user = synced
 	}
 
 	return user, nil
 }
 
+// SyncUserProfile updates the Name and Email of an existing user when they
+// differ from the provided values. Empty values are ignored so a missing claim
+// never clears a field in Grafana.
+func (c *Client) SyncUserProfile(ctx context.Context, user gapi.User, name, email string) (gapi.User, error) {
+	updated := user
+
+	if name != "" && name != user.Name {
+		updated.Name = name
+	}
+
+	// emails are case-insensitive in Grafana
+	if email != "" && !strings.EqualFold(email, user.Email) {
+		updated.Email = email
+	}
+
+	if updated.Name == user.Name && updated.Email == user.Email {
+		return user, nil
+	}
+
+	logger := logging.FromContext(ctx).WithField("grafana_login", user.Login)
+	if c.dryRun {
+		logger = logger.WithField("dry_run", true)
+	}
+	logger.Info("updating user profile")
+	logger.Debugf("profile changed from name=%q email=%q to name=%q email=%q",
+		user.Name, user.Email, updated.Name, updated.Email)
+
+	if c.dryRun {
+		return updated, nil
+	}
+
+	ctx, end := c.instrument(ctx, "UpdateUser")
+	err := c.call(ctx, true, func() error {
+		return newAPIError(c.client.UserUpdate(updated), statusErrors{http.StatusNotFound: ErrUserNotFound})
+	})
+	end(err)
+	if err != nil {
+		return user, err
+	}
+
+	return updated, nil
+}
+
+// isSameIdentity reports whether an existing user agrees with the claims on
+// either the login or the email. Grafana compares both case-insensitively.
+func isSameIdentity(user gapi.User, login, email string) bool {
+	if login != "" && strings.EqualFold(user.Login, login) {
+		return true
+	}
+
+	return email != "" && strings.EqualFold(user.Email, email)
+}
+
 func isRoleAssignable(currentRole RoleType, incomingRole RoleType) bool {
 	// role hierarchy
 	roleHierarchy := map[RoleType]int{
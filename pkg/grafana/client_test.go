@@ -1,9 +1,14 @@
 package grafana
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
@@ -19,30 +24,36 @@ func newUser(login string, id int64) gapi.User {
 }
 
 func TestLookupUser(t *testing.T) {
+	ctx := context.Background()
+
 	user := newUser("foo", 1)
 
 	client := NewMockClient(user, nil)
 
-	foundUser, err := client.LookupUser(user.Login)
+	foundUser, err := client.LookupUser(ctx, user.Login)
 	assert.Nil(t, err)
 	assert.Equal(t, user.Login, foundUser.Login)
 
-	notFoundUser, err := client.LookupUser("")
+	notFoundUser, err := client.LookupUser(ctx, "")
 	assert.Nil(t, err)
 	assert.Equal(t, gapi.User{}, notFoundUser)
 }
 
 func TestCreateUser(t *testing.T) {
+	ctx := context.Background()
+
 	user := newUser("foo", 1)
 
 	client := NewMockClient(user, nil)
 
-	uid, err := client.CreateUser(user)
+	uid, err := client.CreateUser(ctx, user)
 	assert.Nil(t, err)
 	assert.Equal(t, uid, user.ID)
 }
 
 func TestAddOrgUser(t *testing.T) {
+	ctx := context.Background()
+
 	user := newUser("foo", 1)
 
 	orgRoleMap := userOrgsRoleMap{
@@ -51,15 +62,17 @@ func TestAddOrgUser(t *testing.T) {
 	client := NewMockClient(user, orgRoleMap)
 
 	// test adding to new org
-	err := client.AddOrgUser(2, "foo", "Editor")
+	err := client.AddOrgUser(ctx, 2, "foo", "Editor")
 	assert.NoError(t, err)
 
 	// test already a member
-	err = client.AddOrgUser(1, "foo", "Editor")
+	err = client.AddOrgUser(ctx, 1, "foo", "Editor")
 	assert.Contains(t, err.Error(), "User is already member")
 }
 
 func TestUpsertOrgUser(t *testing.T) {
+	ctx := context.Background()
+
 	user := newUser("foo", 1)
 
 	orgRoleMap := userOrgsRoleMap{
@@ -69,20 +82,211 @@ func TestUpsertOrgUser(t *testing.T) {
 	client := NewMockClient(user, orgRoleMap)
 
 	// this should always succeed except for errors when calling the rest api
-	err := client.UpsertOrgUser(1, user, "Editor")
+	err := client.UpsertOrgUser(ctx, 1, user, "Editor")
 	assert.Nil(t, err)
 
 	// upsert will return an error when the orgID is invalid for example
-	err = client.UpsertOrgUser(0, user, "Admin")
+	err = client.UpsertOrgUser(ctx, 0, user, "Admin")
 	assert.NotNil(t, err)
 
 	// if user doesn't exists then Upsert will return an error on update user path
-	err = client.UpsertOrgUser(1, gapi.User{}, "Viewer")
+	err = client.UpsertOrgUser(ctx, 1, gapi.User{}, "Viewer")
 	assert.NotNil(t, err)
 }
 
+func TestUpsertOrgUserChanges(t *testing.T) {
+	ctx := context.Background()
+
+	user := newUser("foo", 1)
+	client := NewMockClient(user, userOrgsRoleMap{1: ROLE_VIEWER})
+
+	changes := []Change{}
+	assert.NoError(t, WithChangeHandler(func(ctx context.Context, change Change) {
+		changes = append(changes, change)
+	})(client))
+
+	// an unchanged role is not updated
+	assert.NoError(t, client.UpsertOrgUser(ctx, 1, user, "Viewer"))
+	assert.Empty(t, changes)
+
+	assert.NoError(t, client.UpsertOrgUser(ctx, 1, user, "Editor"))
+	assert.NoError(t, client.UpsertOrgUser(ctx, 2, user, "Admin"))
+	assert.Equal(t, []Change{
+		{Kind: CHANGE_ORG_ROLE_UPDATED, UserID: 1, Login: "foo", OrgID: 1, OldRole: ROLE_VIEWER, NewRole: ROLE_EDITOR},
+		{Kind: CHANGE_ORG_ROLE_ADDED, UserID: 1, Login: "foo", OrgID: 2, NewRole: ROLE_ADMIN},
+	}, changes)
+}
+
+func TestSyncUserLooksUpRolesOnce(t *testing.T) {
+	ctx := context.Background()
+
+	groups := config.Groups{
+		"foo": {
+			Orgs: []config.Org{
+				{ID: 1, Role: "Viewer"},
+				{ID: 2, Role: "Admin"},
+				{ID: 3, Role: "Editor"},
+			},
+		},
+	}
+
+	user := newUser("foo", 1)
+	client := NewMockClient(user, userOrgsRoleMap{1: ROLE_VIEWER, 2: ROLE_EDITOR})
+
+	changes := []Change{}
+	assert.NoError(t, WithChangeHandler(func(ctx context.Context, change Change) {
+		changes = append(changes, change)
+	})(client))
+
+	_, _, err := client.SyncUser(ctx, "foo", "", "", groups)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Change{
+		{Kind: CHANGE_ORG_ROLE_UPDATED, UserID: 1, Login: "foo", OrgID: 2, OldRole: ROLE_EDITOR, NewRole: ROLE_ADMIN},
+		{Kind: CHANGE_ORG_ROLE_ADDED, UserID: 1, Login: "foo", OrgID: 3, NewRole: ROLE_EDITOR},
+	}, changes)
+
+	m := client.client.(*mockGAPIClient)
+	assert.Equal(t, 1, m.userOrgsCalls)
+}
+
+func TestUserOrgs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if r.URL.Path != "/grafana/api/users/7/orgs" || !ok || user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"user not found"}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"orgId":1,"name":"Main Org.","role":"Viewer"},{"orgId":2,"name":"Payments","role":"Admin"}]`)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL + "/grafana")
+	assert.NoError(t, err)
+
+	client, err := NewClient(serverURL, gapi.Config{
+		Client:    server.Client(),
+		BasicAuth: url.UserPassword("admin", "secret"),
+	})
+	assert.NoError(t, err)
+
+	roles, err := client.userOrgRoles(context.Background(), 7)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]RoleType{1: ROLE_VIEWER, 2: ROLE_ADMIN}, roles)
+
+	_, err = client.userOrgRoles(context.Background(), 8)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestSyncUserDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	groups := config.Groups{
+		"foo": {
+			GrafanaAdmin: true,
+			Orgs: []config.Org{
+				{ID: 1, Role: "Editor"},
+				{ID: 2, Role: "Viewer"},
+			},
+		},
+	}
+
+	// existing user
+	user := newUser("foo", 1)
+	client := NewMockClient(user, userOrgsRoleMap{1: ROLE_VIEWER})
+
+	changes := []Change{}
+	for _, opt := range []ClientFuncOpt{
+		WithDryRun(),
+		WithChangeHandler(func(ctx context.Context, change Change) {
+			changes = append(changes, change)
+		}),
+	} {
+		assert.NoError(t, opt(client))
+	}
+
+	synced, orgRoles, err := client.SyncUser(ctx, "foo", "Foo", "foo@example.com", groups)
+	assert.NoError(t, err)
+	// the profile is returned as it would have been updated
+	assert.Equal(t, "Foo", synced.Name)
+	assert.Equal(t, map[int64]RoleType{1: ROLE_EDITOR, 2: ROLE_VIEWER}, orgRoles)
+	assert.ElementsMatch(t, []Change{
+		{Kind: CHANGE_GRAFANA_ADMIN_GRANTED, UserID: 1},
+		{Kind: CHANGE_ORG_ROLE_UPDATED, UserID: 1, Login: "foo", OrgID: 1, OldRole: ROLE_VIEWER, NewRole: ROLE_EDITOR},
+		{Kind: CHANGE_ORG_ROLE_ADDED, UserID: 1, Login: "foo", OrgID: 2, NewRole: ROLE_VIEWER},
+	}, changes)
+
+	m := client.client.(*mockGAPIClient)
+	m.AssertNotCalled(t, "UpdateUserPermissions")
+	assert.Empty(t, m.updatedUsers)
+
+	// new user
+	changes = []Change{}
+	_, _, err = client.SyncUser(ctx, "bar", "Bar", "bar@example.com", groups)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Change{
+		{Kind: CHANGE_USER_CREATED, Login: "bar"},
+		{Kind: CHANGE_GRAFANA_ADMIN_GRANTED},
+		{Kind: CHANGE_ORG_ROLE_ADDED, Login: "bar", OrgID: 1, NewRole: ROLE_EDITOR},
+		{Kind: CHANGE_ORG_ROLE_ADDED, Login: "bar", OrgID: 2, NewRole: ROLE_VIEWER},
+	}, changes)
+}
+
+func TestSyncUserNamedOrgsAndTeams(t *testing.T) {
+	ctx := context.Background()
+
+	groups := config.Groups{
+		"foo": {
+			Orgs: []config.Org{
+				{Name: "Payments", Role: "Editor"},
+				{Name: "Unknown", Role: "Admin"},
+			},
+			Teams: []config.Team{
+				{OrgName: "Payments", Name: "payments-oncall"},
+				{OrgID: 2, Name: "missing"},
+				{OrgName: "Unknown", Name: "payments"},
+			},
+		},
+		"bar": {
+			Orgs:  []config.Org{{ID: 1, Role: "Viewer"}},
+			Teams: []config.Team{{OrgID: 2, Name: "payments-oncall"}},
+		},
+	}
+
+	user := newUser("foo", 1)
+	client := NewMockClient(user, userOrgsRoleMap{})
+
+	changes := []Change{}
+	assert.NoError(t, WithChangeHandler(func(ctx context.Context, change Change) {
+		changes = append(changes, change)
+	})(client))
+
+	_, orgRoles, err := client.SyncUser(ctx, "foo", "", "", groups)
+	assert.NoError(t, err)
+	// unknown orgs are skipped
+	assert.Equal(t, map[int64]RoleType{1: ROLE_VIEWER, 2: ROLE_EDITOR}, orgRoles)
+	// the team is only joined once, and a missing team doesn't fail the sync
+	assert.Contains(t, changes, Change{Kind: CHANGE_TEAM_MEMBER_ADDED, UserID: 1, Login: "foo", OrgID: 2, Team: "payments-oncall"})
+
+	m := client.client.(*mockGAPIClient)
+	assert.Equal(t, map[int64][]int64{2: {1}}, m.teamMembers)
+
+	// existing members are not added again
+	changes = []Change{}
+	_, _, err = client.SyncUser(ctx, "foo", "", "", groups)
+	assert.NoError(t, err)
+	assert.NotContains(t, changes, Change{Kind: CHANGE_TEAM_MEMBER_ADDED, UserID: 1, Login: "foo", OrgID: 2, Team: "payments-oncall"})
+	assert.Equal(t, map[int64][]int64{2: {1}}, m.teamMembers)
+
+	assert.ErrorIs(t, client.AddTeamMember(ctx, 2, "payments-on", user), ErrTeamNotFound)
+}
+
 // This is a silly test as the mock always returns nil but it's here for completeness
 func TestUpdateUserPermissions(t *testing.T) {
+	ctx := context.Background()
+
 	user := newUser("foo", 1)
 
 	client := NewMockClient(user, userOrgsRoleMap{})
@@ -94,13 +298,15 @@ func TestUpdateUserPermissions(t *testing.T) {
 
 	m.On("UpdateUserPermissions", int64(1), true).Return(nil)
 
-	err := client.UpdateUserPermissions(user.ID, true)
+	err := client.UpdateUserPermissions(ctx, user.ID, true)
 	assert.NoError(t, err)
 
 	m.AssertExpectations(t)
 }
 
 func TestUpdateOrgUserAuthz(t *testing.T) {
+	ctx := context.Background()
+
 	adminUser := newUser("foo", 1)
 	adminUser.IsAdmin = true
 
@@ -300,7 +506,7 @@ func TestUpdateOrgUserAuthz(t *testing.T) {
 			}
 		}
 
-		orgsRoleMap, err := client.UpdateOrgUserAuthz(test.user, test.groups)
+		orgsRoleMap, err := client.UpdateOrgUserAuthz(ctx, test.user, test.groups)
 
 		m.AssertExpectations(t)
 		m.AssertNumberOfCalls(t, "UpdateUserPermissions", test.expectedUpdateCalls)
@@ -314,19 +520,84 @@ func TestUpdateOrgUserAuthz(t *testing.T) {
 	}
 }
 
+func TestResolveOrgRoles(t *testing.T) {
+	tests := []struct {
+		groups        config.Groups
+		expected      map[int64]RoleType
+		expectedAdmin bool
+	}{
+		{
+			groups:   config.Groups{},
+			expected: map[int64]RoleType{},
+		},
+		// the most permissive role of each org wins
+		{
+			groups: config.Groups{
+				"foo": {
+					Orgs: []config.Org{
+						{ID: 1, Role: "Viewer"},
+						{ID: 2, Role: "Admin"},
+					},
+				},
+				"bar": {
+					Orgs: []config.Org{
+						{ID: 1, Role: "Editor"},
+						{ID: 2, Role: "Viewer"},
+					},
+				},
+			},
+			expected: map[int64]RoleType{1: ROLE_EDITOR, 2: ROLE_ADMIN},
+		},
+		// one group is enough to be a Grafana admin
+		{
+			groups: config.Groups{
+				"foo": {GrafanaAdmin: true},
+				"bar": {
+					Orgs: []config.Org{{ID: 3, Role: "Viewer"}},
+				},
+			},
+			expected:      map[int64]RoleType{3: ROLE_VIEWER},
+			expectedAdmin: true,
+		},
+		// orgs referenced by name are resolved separately
+		{
+			groups: config.Groups{
+				"foo": {
+					Orgs: []config.Org{{ID: 1, Role: "Viewer"}, {Name: "Payments", Role: "Admin"}},
+				},
+			},
+			expected: map[int64]RoleType{1: ROLE_VIEWER},
+		},
+	}
+
+	for _, test := range tests {
+		orgRoles, isAdmin := ResolveOrgRoles(test.groups)
+		assert.Equal(t, test.expected, orgRoles)
+		assert.Equal(t, test.expectedAdmin, isAdmin)
+	}
+
+	namedOrgRoles := ResolveNamedOrgRoles(config.Groups{
+		"foo": {Orgs: []config.Org{{ID: 1, Role: "Admin"}, {Name: "Payments", Role: "Editor"}}},
+		"bar": {Orgs: []config.Org{{Name: "Payments", Role: "Viewer"}, {Name: "Billing", Role: "Admin"}}},
+	})
+	assert.Equal(t, map[string]RoleType{"Payments": ROLE_EDITOR, "Billing": ROLE_ADMIN}, namedOrgRoles)
+}
+
 func TestGetOrCreateUser(t *testing.T) {
+	ctx := context.Background()
+
 	// Existing user
 	user := newUser("foo", 1)
 
 	client := NewMockClient(user, userOrgsRoleMap{})
 
 	// Existing users, only Login is used for lookup
-	orgUser, err := client.GetOrCreateUser("foo", "", "")
+	orgUser, err := client.GetOrCreateUser(ctx, "foo", "", "")
 	assert.NoError(t, err)
 	assert.Equal(t, user, orgUser)
 
 	// New user
-	newUser, err := client.GetOrCreateUser("new", "foo", "bar@foo.com")
+	newUser, err := client.GetOrCreateUser(ctx, "new", "foo", "bar@foo.com")
 	assert.NoError(t, err)
 	// for convenience the CreateUser mock returns the same ID as the user.ID
 	// passed in NewMockClient
@@ -335,6 +606,183 @@ func TestGetOrCreateUser(t *testing.T) {
 	assert.Equal(t, "bar@foo.com", newUser.Email)
 }
 
+func TestFindUser(t *testing.T) {
+	ctx := context.Background()
+
+	// the existing user has a login that differs from its email
+	user := newUser("foo", 1)
+
+	tests := []struct {
+		strategy LookupStrategy
+		login    string
+		email    string
+		found    bool
+		lookups  int
+	}{
+		{strategy: LOOKUP_LOGIN, login: "foo", email: "other@example.com", found: true, lookups: 1},
+		{strategy: LOOKUP_LOGIN, login: "bar", email: "foo@example.com", found: false, lookups: 1},
+		{strategy: LOOKUP_EMAIL, login: "foo", email: "other@example.com", found: false, lookups: 1},
+		{strategy: LOOKUP_EMAIL, login: "bar", email: "foo@example.com", found: true, lookups: 1},
+		{strategy: LOOKUP_LOGIN_THEN_EMAIL, login: "foo", email: "other@example.com", found: true, lookups: 1},
+		{strategy: LOOKUP_LOGIN_THEN_EMAIL, login: "bar", email: "foo@example.com", found: true, lookups: 2},
+		{strategy: LOOKUP_LOGIN_THEN_EMAIL, login: "bar", email: "", found: false, lookups: 1},
+		// the login and the email come from the same claim
+		{strategy: LOOKUP_LOGIN_THEN_EMAIL, login: "bar@example.com", email: "bar@example.com", found: false, lookups: 1},
+	}
+
+	for _, test := range tests {
+		client := NewMockClient(user, nil)
+		assert.NoError(t, WithLookupStrategy(test.strategy)(client))
+
+		foundUser, err := client.FindUser(ctx, test.login, test.email)
+		assert.NoError(t, err)
+		assert.Equal(t, test.found, foundUser.Login != "", "%s %s %s", test.strategy, test.login, test.email)
+		assert.Equal(t, test.lookups, client.client.(*mockGAPIClient).lookups, "%s %s %s", test.strategy, test.login, test.email)
+	}
+
+	client := NewMockClient(user, nil)
+	assert.ErrorIs(t, WithLookupStrategy("sub")(client), ErrLookupNotValid)
+}
+
+func TestGetOrCreateUserIdentityMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	// an unrelated user whose email happens to be the subject of the token
+	user := gapi.User{ID: 1, Login: "alice", Email: "jdoe"}
+
+	client := NewMockClient(user, userOrgsRoleMap{})
+	assert.NoError(t, WithLookupStrategy(LOOKUP_LOGIN)(client))
+
+	_, err := client.GetOrCreateUser(ctx, "jdoe", "jdoe", "jdoe@example.com")
+	assert.ErrorIs(t, err, ErrUserIdentityMismatch)
+
+	// the same user is linked when either the login or the email agree
+	orgUser, err := client.GetOrCreateUser(ctx, "jdoe", "", "JDOE")
+	assert.NoError(t, err)
+	assert.Equal(t, user, orgUser)
+}
+
+func TestGetOrCreateUserProfileSync(t *testing.T) {
+	ctx := context.Background()
+
+	user := newUser("foo", 1)
+	user.Name = "Foo"
+
+	tests := []struct {
+		name     string
+		opts     []ClientFuncOpt
+		newName  string
+		newEmail string
+		expected gapi.User
+		updates  int
+	}{
+		{
+			name:     "unchanged claims",
+			newName:  "Foo",
+			newEmail: "foo@example.com",
+			expected: user,
+		},
+		{
+			name:     "empty claims are ignored",
+			expected: user,
+		},
+		{
+			name:     "changed name and email",
+			newName:  "Foo Bar",
+			newEmail: "foo.bar@example.com",
+			expected: gapi.User{ID: 1, Login: "foo", Name: "Foo Bar", Email: "foo.bar@example.com"},
+			updates:  1,
+		},
+		{
+			name:     "profile sync disabled",
+			opts:     []ClientFuncOpt{WithoutUserProfileSync()},
+			newName:  "Foo Bar",
+			newEmail: "foo.bar@example.com",
+			expected: user,
+		},
+	}
+
+	for _, test := range tests {
+		client := NewMockClient(user, userOrgsRoleMap{})
+		for _, opt := range test.opts {
+			assert.NoError(t, opt(client))
+		}
+
+		m, ok := client.client.(*mockGAPIClient)
+		if !ok {
+			t.Fail()
+		}
+
+		orgUser, err := client.GetOrCreateUser(ctx, "foo", test.newName, test.newEmail)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, orgUser, test.name)
+		assert.Len(t, m.updatedUsers, test.updates, test.name)
+	}
+}
+
+func TestSyncUserProfileConflict(t *testing.T) {
+	ctx := context.Background()
+
+	user := newUser("foo", 1)
+	client := NewMockClient(user, userOrgsRoleMap{})
+
+	// the new email belongs to another user
+	m := client.client.(*mockGAPIClient)
+	m.userUpdateErr = errors.New(`status: 409, body: {"message":"Email is already in use"}`)
+
+	groups := config.Groups{"foo": {Orgs: []config.Org{{ID: 1, Role: "Viewer"}}}}
+	synced, orgRoles, err := client.SyncUser(ctx, "foo", "Foo", "taken@example.com", groups)
+	assert.NoError(t, err)
+	assert.Equal(t, user, synced)
+	assert.Equal(t, map[int64]RoleType{1: ROLE_VIEWER}, orgRoles)
+}
+
+func TestHealthChecks(t *testing.T) {
+	ctx := context.Background()
+
+	client := NewMockClient(newUser("foo", 1), userOrgsRoleMap{})
+	assert.NoError(t, client.Health(ctx))
+	assert.NoError(t, client.CheckAdminAccess(ctx))
+
+	client = newStatusClient(t, http.StatusServiceUnavailable, "database is down")
+	assert.Error(t, client.Health(ctx))
+
+	client = newStatusClient(t, http.StatusUnauthorized, "invalid username or password")
+	var apiErr *APIError
+	assert.ErrorAs(t, client.CheckAdminAccess(ctx), &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+}
+
+func TestHealthChecksTimeout(t *testing.T) {
+	// Grafana accepts the connections but never answers
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	client, err := NewClient(serverURL, gapi.Config{Client: server.Client()})
+	assert.NoError(t, err)
+
+	for name, check := range map[string]func(context.Context) error{
+		"health":       client.Health,
+		"admin access": client.CheckAdminAccess,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := check(ctx)
+		cancel()
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded, name)
+		assert.True(t, IsUnavailable(err), name)
+		assert.Less(t, time.Since(start), 5*time.Second, name)
+	}
+}
+
 func TestIsRoleAssignable(t *testing.T) {
 	// table test to  validate isRoleAssignable(currentRole, incomingRole)
 	assert.True(t, isRoleAssignable("", ROLE_VIEWER))
@@ -0,0 +1,90 @@
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// gapi only exposes a typed error for 404, every other non-successful
+// response is formatted with this layout.
+var gapiErrorRegexp = regexp.MustCompile(`(?s)^status: (\d+), body: (.*)$`)
+
+// APIError is returned by Client when the Grafana API answers with a
+// non-successful status code. Callers can use errors.Is against the sentinel
+// errors of this package, e.g. ErrUserNotFound, for the status codes that
+// have a meaning for the call that failed.
+type APIError struct {
+	StatusCode int
+	Message    string
+	err        error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("grafana api: status: %d, message: %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// statusErrors maps a status code to the sentinel error it represents for a
+// given API call.
+type statusErrors map[int]error
+
+// newAPIError converts an error returned by gapi into an APIError. Errors that
+// are not caused by a response from Grafana, like network errors, are
+// returned unchanged.
+func newAPIError(err error, sentinels statusErrors) error {
+	if err == nil {
+		return nil
+	}
+
+	var statusCode int
+	var body string
+
+	var notFound gapi.ErrNotFound
+	if errors.As(err, &notFound) {
+		statusCode = http.StatusNotFound
+		body = string(notFound.BodyContents)
+	} else {
+		matches := gapiErrorRegexp.FindStringSubmatch(err.Error())
+		if matches == nil {
+			return err
+		}
+
+		code, convErr := strconv.Atoi(matches[1])
+		if convErr != nil {
+			return err
+		}
+
+		statusCode = code
+		body = matches[2]
+	}
+
+	return &APIError{
+		StatusCode: statusCode,
+		Message:    apiErrorMessage(body),
+		err:        sentinels[statusCode],
+	}
+}
+
+// apiErrorMessage extracts the message field from a Grafana error body,
+// falling back to the raw body when it is not JSON.
+func apiErrorMessage(body string) string {
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+
+	if err := json.Unmarshal([]byte(body), &msg); err == nil && msg.Message != "" {
+		return msg.Message
+	}
+
+	return strings.TrimSpace(body)
+}
@@ -0,0 +1,115 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStatusClient returns a Client backed by a real gapi client talking to a
+// server that answers every request with the given status code and message,
+// the same way Grafana formats its API errors.
+func newStatusClient(t *testing.T, statusCode int, message string) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		fmt.Fprintf(w, `{"message":%q}`, message)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	client, err := NewClient(serverURL, gapi.Config{Client: server.Client()})
+	assert.NoError(t, err)
+
+	return client
+}
+
+func TestNewAPIError(t *testing.T) {
+	assert.NoError(t, newAPIError(nil, nil))
+
+	// errors not caused by an API response are returned unchanged
+	networkErr := errors.New("dial tcp: connection refused")
+	assert.Equal(t, networkErr, newAPIError(networkErr, nil))
+
+	err := newAPIError(errors.New(`status: 409, body: {"message":"conflict"}`), statusErrors{http.StatusConflict: ErrOrgUserAlreadyMember})
+	var apiErr *APIError
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	assert.Equal(t, "conflict", apiErr.Message)
+	assert.ErrorIs(t, err, ErrOrgUserAlreadyMember)
+
+	// non JSON bodies are kept as the message
+	err = newAPIError(gapi.ErrNotFound{BodyContents: []byte("not found")}, nil)
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "not found", apiErr.Message)
+	assert.NotErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestAPIErrorStatusCodes(t *testing.T) {
+	ctx := context.Background()
+
+	user := newUser("foo", 1)
+
+	tests := []struct {
+		statusCode    int
+		message       string
+		lookupErr     bool
+		upsertErr     error
+		userNotFound  bool
+		alreadyMember bool
+	}{
+		{statusCode: http.StatusBadRequest, message: "bad request", lookupErr: true},
+		{statusCode: http.StatusUnauthorized, message: "invalid username or password", lookupErr: true},
+		{statusCode: http.StatusForbidden, message: "permission denied", lookupErr: true},
+		{statusCode: http.StatusNotFound, message: "user not found", userNotFound: true},
+		{statusCode: http.StatusConflict, message: "User is already member of this organization", lookupErr: true, alreadyMember: true},
+		{statusCode: http.StatusPreconditionFailed, message: "precondition failed", lookupErr: true},
+		{statusCode: http.StatusInternalServerError, message: "internal server error", lookupErr: true},
+		{statusCode: http.StatusServiceUnavailable, message: "service unavailable", lookupErr: true},
+	}
+
+	for _, test := range tests {
+		client := newStatusClient(t, test.statusCode, test.message)
+		name := http.StatusText(test.statusCode)
+
+		// a missing user is not an error for lookups
+		foundUser, err := client.LookupUser(ctx, "foo")
+		if test.lookupErr {
+			var apiErr *APIError
+			assert.ErrorAs(t, err, &apiErr, name)
+			assert.Equal(t, test.statusCode, apiErr.StatusCode, name)
+			assert.Equal(t, test.message, apiErr.Message, name)
+		} else {
+			assert.NoError(t, err, name)
+			assert.Equal(t, gapi.User{}, foundUser, name)
+		}
+
+		err = client.AddOrgUser(ctx, 1, "foo", "Viewer")
+		assert.Error(t, err, name)
+		assert.Equal(t, test.userNotFound, errors.Is(err, ErrUserNotFound), name)
+		assert.Equal(t, test.alreadyMember, errors.Is(err, ErrOrgUserAlreadyMember), name)
+
+		// the conflict is handled by UpsertOrgUser which then fails on the update
+		err = client.UpsertOrgUser(ctx, 1, user, "Viewer")
+		assert.Error(t, err, name)
+		assert.NotErrorIs(t, err, ErrOrgUserAlreadyMember, name)
+
+		_, err = client.CreateUser(ctx, user)
+		assert.Error(t, err, name)
+
+		err = client.UpdateUserPermissions(ctx, user.ID, true)
+		assert.Equal(t, test.userNotFound, errors.Is(err, ErrUserNotFound), name)
+	}
+}
@@ -0,0 +1,63 @@
+package grafana
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	apiDuration  *prometheus.HistogramVec
+	apiErrors    *prometheus.CounterVec
+	usersCreated prometheus.Counter
+	roleChanges  *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grafana_auth_proxy_grafana_api_duration_seconds",
+			Help:    "Latency of Grafana admin API calls by operation, including retries.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grafana_auth_proxy_grafana_api_errors_total",
+			Help: "Failed Grafana admin API calls by operation.",
+		}, []string{"operation"}),
+		usersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "grafana_auth_proxy_grafana_users_created_total",
+			Help: "Users created in Grafana.",
+		}),
+		roleChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grafana_auth_proxy_grafana_role_changes_total",
+			Help: "Org role and Grafana admin changes applied to users.",
+		}, []string{"change"}),
+	}
+}
+
+// WithMetrics registers the Grafana admin API metrics in reg.
+func WithMetrics(reg prometheus.Registerer) ClientFuncOpt {
+	return func(c *Client) error {
+		for _, collector := range []prometheus.Collector{
+			c.metrics.apiDuration,
+			c.metrics.apiErrors,
+			c.metrics.usersCreated,
+			c.metrics.roleChanges,
+		} {
+			if err := reg.Register(collector); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// observe records the latency and result of an operation started at start.
+func (m *metrics) observe(operation string, start time.Time, err error) {
+	m.apiDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.apiErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,31 @@
+package grafana
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	client := NewMockClient(newUser("foo", 1), nil)
+	assert.NoError(t, WithMetrics(prometheus.NewRegistry())(client))
+
+	client.client.(*mockGAPIClient).On("UpdateUserPermissions", int64(1), true).Return(nil)
+
+	_, err := client.CreateUser(ctx, newUser("bar", 2))
+	assert.NoError(t, err)
+	assert.NoError(t, client.UpdateUserPermissions(ctx, 1, true))
+	assert.Equal(t, float64(1), testutil.ToFloat64(client.metrics.usersCreated))
+	assert.Equal(t, float64(1), testutil.ToFloat64(client.metrics.roleChanges.WithLabelValues(string(CHANGE_GRAFANA_ADMIN_GRANTED))))
+
+	client = newStatusClient(t, http.StatusForbidden, "Permission denied")
+	_, err = client.CreateUser(ctx, newUser("bar", 2))
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(client.metrics.apiErrors.WithLabelValues("CreateUser")))
+}
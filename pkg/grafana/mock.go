@@ -2,6 +2,7 @@ package grafana
 
 import (
 	"errors"
+	"strings"
 
 	gapi "github.com/grafana/grafana-api-golang-client"
 	"github.com/stretchr/testify/mock"
@@ -11,15 +12,30 @@ import (
 type mockGAPIClient struct {
 	user       gapi.User
 	orgRoleMap userOrgsRoleMap
+	// updatedUsers records every call to UserUpdate
+	updatedUsers []gapi.User
+	orgNames     map[string]int64
+	teams        []*gapi.Team
+	// teamMembers has the user IDs of every team by team ID
+	teamMembers map[int64][]int64
+	// userOrgsCalls counts the calls to UserOrgs
+	userOrgsCalls int
+	// lookups counts the calls to UserByEmail
+	lookups int
+	// userUpdateErr is returned by UserUpdate when set
+	userUpdateErr error
 	mock.Mock
 }
 
 func (c *mockGAPIClient) UserByEmail(login string) (gapi.User, error) {
-	if c.user.Login == login {
+	c.lookups++
+
+	// Grafana matches the lookup against both login and email
+	if c.user.Login == login || (c.user.Email != "" && c.user.Email == login) {
 		return c.user, nil
 	}
 
-	return gapi.User{}, errors.New(`body: "User not found"`)
+	return gapi.User{}, gapi.ErrNotFound{BodyContents: []byte(`{"message":"user not found"}`)}
 }
 
 func (c *mockGAPIClient) CreateUser(user gapi.User) (int64, error) {
@@ -29,7 +45,7 @@ func (c *mockGAPIClient) CreateUser(user gapi.User) (int64, error) {
 
 func (c *mockGAPIClient) AddOrgUser(orgID int64, login string, role string) error {
 	if _, ok := c.orgRoleMap[orgID]; ok {
-		return errors.New(`status: 409, body: "User is already member of this organization"`)
+		return errors.New(`status: 409, body: {"message":"User is already member of this organization"}`)
 	}
 
 	// force an error when orgID is 0
@@ -49,6 +65,21 @@ func (c *mockGAPIClient) UpdateOrgUser(orgID, userID int64, role string) error {
 	return nil
 }
 
+func (c *mockGAPIClient) UserOrgs(userID int64) ([]UserOrg, error) {
+	c.userOrgsCalls++
+
+	orgs := []UserOrg{}
+	if userID != c.user.ID {
+		return orgs, nil
+	}
+
+	for orgID, role := range c.orgRoleMap {
+		orgs = append(orgs, UserOrg{OrgID: orgID, Role: string(role)})
+	}
+
+	return orgs, nil
+}
+
 func (c *mockGAPIClient) UpdateUserPermissions(id int64, isAdmin bool) error {
 	args := c.Called(id, isAdmin)
 	if id == 0 {
@@ -58,12 +89,86 @@ func (c *mockGAPIClient) UpdateUserPermissions(id int64, isAdmin bool) error {
 	return args.Error(0)
 }
 
+func (c *mockGAPIClient) UserUpdate(user gapi.User) error {
+	if user.ID == 0 {
+		return errors.New("user has no id")
+	}
+
+	if c.userUpdateErr != nil {
+		return c.userUpdateErr
+	}
+
+	c.updatedUsers = append(c.updatedUsers, user)
+
+	return nil
+}
+
+func (c *mockGAPIClient) Health() (gapi.HealthResponse, error) {
+	return gapi.HealthResponse{Database: "ok"}, nil
+}
+
+func (c *mockGAPIClient) Orgs() ([]gapi.Org, error) {
+	orgs := []gapi.Org{}
+	for orgID := range c.orgRoleMap {
+		orgs = append(orgs, gapi.Org{ID: orgID})
+	}
+
+	return orgs, nil
+}
+
+func (c *mockGAPIClient) OrgByName(name string) (gapi.Org, error) {
+	id, ok := c.orgNames[name]
+	if !ok {
+		return gapi.Org{}, gapi.ErrNotFound{BodyContents: []byte(`{"message":"Organization not found"}`)}
+	}
+
+	return gapi.Org{ID: id, Name: name}, nil
+}
+
+func (c *mockGAPIClient) SearchOrgTeam(orgID int64, query string) ([]*gapi.Team, error) {
+	// Grafana matches partial names
+	teams := []*gapi.Team{}
+	for _, team := range c.teams {
+		if team.OrgID == orgID && strings.Contains(team.Name, query) {
+			teams = append(teams, team)
+		}
+	}
+
+	return teams, nil
+}
+
+func (c *mockGAPIClient) OrgTeamMembers(orgID, teamID int64) ([]*gapi.TeamMember, error) {
+	members := []*gapi.TeamMember{}
+	for _, userID := range c.teamMembers[teamID] {
+		members = append(members, &gapi.TeamMember{OrgID: orgID, TeamID: teamID, UserID: userID})
+	}
+
+	return members, nil
+}
+
+func (c *mockGAPIClient) AddOrgTeamMember(orgID, teamID, userID int64) error {
+	if userID == 0 {
+		return errors.New("user has no id")
+	}
+
+	c.teamMembers[teamID] = append(c.teamMembers[teamID], userID)
+
+	return nil
+}
+
 // MockClient returns a Client using a mocked GAPIClient underneat
 func NewMockClient(user gapi.User, orgRoleMap map[int64]RoleType) *Client {
 	return &Client{
 		client: &mockGAPIClient{
 			user:       user,
 			orgRoleMap: orgRoleMap,
+			orgNames:   map[string]int64{"Main Org.": 1, "Payments": 2},
+			teams: []*gapi.Team{
+				{ID: 1, OrgID: 2, Name: "payments"},
+				{ID: 2, OrgID: 2, Name: "payments-oncall"},
+			},
+			teamMembers: map[int64][]int64{},
 		},
+		metrics: newMetrics(),
 	}
 }
@@ -0,0 +1,93 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// UserOrg is an org a user is a member of, with the user's role in it.
+type UserOrg struct {
+	OrgID int64  `json:"orgId"`
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+}
+
+// UserOrgs returns the orgs of a user. gapi has no call for it, so the
+// request is sent like gapi sends its own.
+func (c gapiClient) UserOrgs(userID int64) ([]UserOrg, error) {
+	requestURL := c.baseURL
+	requestURL.Path = path.Join(requestURL.Path, fmt.Sprintf("/api/users/%d/orgs", userID))
+	if c.config.BasicAuth != nil {
+		requestURL.User = c.config.BasicAuth
+	}
+
+	req, err := http.NewRequest(http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+	for key, value := range c.config.HTTPHeaders {
+		req.Header.Add(key, value)
+	}
+
+	httpClient := c.config.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same errors as gapi, so newAPIError handles them
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, gapi.ErrNotFound{BodyContents: body}
+	case resp.StatusCode >= http.StatusBadRequest:
+		return nil, fmt.Errorf("status: %d, body: %s", resp.StatusCode, body)
+	}
+
+	var orgs []UserOrg
+	if err := json.Unmarshal(body, &orgs); err != nil {
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+// userOrgRoles returns the role of a user in every org it is a member of,
+// with a single call whatever the number of orgs.
+func (c *Client) userOrgRoles(ctx context.Context, userID int64) (map[int64]RoleType, error) {
+	var orgs []UserOrg
+	err := c.call(ctx, true, func() error {
+		var err error
+		orgs, err = c.client.UserOrgs(userID)
+		return newAPIError(err, statusErrors{http.StatusNotFound: ErrUserNotFound})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make(map[int64]RoleType, len(orgs))
+	for _, org := range orgs {
+		roles[org.OrgID] = RoleType(org.Role)
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,111 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+)
+
+// RetryConfig configures how idempotent Grafana API calls are retried when
+// Grafana is unavailable. Backoff grows exponentially from InitialBackoff up
+// to MaxBackoff and a random jitter is applied to every wait.
+type RetryConfig struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// WithRetry enables retries of idempotent calls.
+func WithRetry(cfg RetryConfig) ClientFuncOpt {
+	return func(c *Client) error {
+		c.retry = cfg
+		return nil
+	}
+}
+
+// backoff returns the time to wait before the given retry attempt, starting
+// at 1, using "full jitter".
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	limit := r.MaxBackoff
+	if limit <= 0 {
+		limit = r.InitialBackoff
+	}
+
+	wait := r.InitialBackoff
+	for i := 1; i < attempt && wait < limit; i++ {
+		wait *= 2
+	}
+
+	if wait > limit {
+		wait = limit
+	}
+
+	if wait <= 0 {
+		return 0
+	}
+
+	return rand.N(wait) + 1
+}
+
+// IsUnavailable reports whether err means that Grafana could not serve the
+// request, either because the circuit breaker is open, because Grafana
+// didn't answer in time or because the request failed with a network error or
+// a server side status code.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) || isRetryable(err)
+}
+
+// isRetryable reports whether a failed call can succeed when repeated.
+func isRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	// gapi returns the error from http.Client.Do for connection failures
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// call runs fn through the circuit breaker. Idempotent calls are retried with
+// backoff while they fail with a retryable error.
+func (c *Client) call(ctx context.Context, idempotent bool, fn func() error) error {
+	attempts := 1
+	if idempotent && c.retry.MaxRetries > 0 {
+		attempts += c.retry.MaxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := c.retry.backoff(attempt)
+			logging.FromContext(ctx).Debugf("retrying Grafana API call in %s, attempt %d of %d: %v", wait, attempt, c.retry.MaxRetries, err)
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+
+		if openErr := c.breaker.allow(); openErr != nil {
+			return openErr
+		}
+
+		err = fn()
+		c.breaker.record(isRetryable(err))
+
+		if !isRetryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
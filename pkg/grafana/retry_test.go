@@ -0,0 +1,128 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyClient returns a Client whose Grafana answers the first `failures`
+// requests with a 503 and any following one with a user lookup response.
+func newFlakyClient(t *testing.T, failures int32, opts ...ClientFuncOpt) (*Client, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"message":"restarting"}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"id":1,"login":"foo","email":"foo@example.com"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	client, err := NewClient(serverURL, gapi.Config{Client: server.Client()}, opts...)
+	assert.NoError(t, err)
+
+	return client, &requests
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		wait := cfg.backoff(attempt)
+		assert.Greater(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, cfg.MaxBackoff)
+	}
+
+	assert.Equal(t, time.Duration(0), RetryConfig{}.backoff(1))
+}
+
+func TestCallRetries(t *testing.T) {
+	ctx := context.Background()
+	retry := WithRetry(RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	// recovers within the retries
+	client, requests := newFlakyClient(t, 2, retry)
+	user, err := client.LookupUser(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", user.Login)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// gives up after the retries
+	client, requests = newFlakyClient(t, 5, retry)
+	_, err = client.LookupUser(ctx, "foo")
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, int32(3), requests.Load())
+
+	// non idempotent calls are never retried
+	client, requests = newFlakyClient(t, 5, retry)
+	_, err = client.CreateUser(ctx, newUser("foo", 0))
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, int32(1), requests.Load())
+
+	// a cancelled context stops retrying
+	client, requests = newFlakyClient(t, 5, WithRetry(RetryConfig{MaxRetries: 2, InitialBackoff: time.Hour}))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.LookupUser(cancelled, "foo")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	client, requests := newFlakyClient(t, 2, WithCircuitBreaker(BreakerConfig{Threshold: 2, Cooldown: time.Minute}))
+	client.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err := client.LookupUser(ctx, "foo")
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+
+	// the breaker is open and Grafana is not called
+	_, err := client.LookupUser(ctx, "foo")
+	var openErr *CircuitOpenError
+	assert.True(t, errors.As(err, &openErr))
+	assert.Equal(t, time.Minute, openErr.RetryAfter)
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// after the cooldown a probe is allowed and closes the breaker
+	now = now.Add(time.Minute)
+	user, err := client.LookupUser(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", user.Login)
+
+	_, err = client.LookupUser(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), requests.Load())
+}
+
+func TestIsUnavailable(t *testing.T) {
+	assert.False(t, IsUnavailable(nil))
+	assert.False(t, IsUnavailable(ErrUserIdentityMismatch))
+	assert.False(t, IsUnavailable(&APIError{StatusCode: http.StatusUnauthorized}))
+	assert.True(t, IsUnavailable(&APIError{StatusCode: http.StatusTooManyRequests}))
+	assert.True(t, IsUnavailable(&APIError{StatusCode: http.StatusBadGateway}))
+	assert.True(t, IsUnavailable(&url.Error{Op: "Get", URL: "http://grafana", Err: errors.New("connection refused")}))
+	assert.True(t, IsUnavailable(&CircuitOpenError{}))
+	assert.True(t, IsUnavailable(fmt.Errorf("grafana didn't answer in time: %w", context.DeadlineExceeded)))
+}
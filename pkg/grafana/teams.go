@@ -0,0 +1,207 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/config"
+	"github.com/kanopy-platform/grafana-auth-proxy/pkg/logging"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrOrgNotFound  = errors.New("org not found")
+	ErrTeamNotFound = errors.New("team not found")
+)
+
+// gapiClient adds the calls scoped to an org to gapi.Client, which scopes
+// them with a copy of the client per org, and the calls gapi doesn't have.
+type gapiClient struct {
+	*gapi.Client
+	baseURL url.URL
+	config  gapi.Config
+}
+
+func (c gapiClient) SearchOrgTeam(orgID int64, query string) ([]*gapi.Team, error) {
+	result, err := c.WithOrgID(orgID).SearchTeam(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Teams, nil
+}
+
+func (c gapiClient) OrgTeamMembers(orgID, teamID int64) ([]*gapi.TeamMember, error) {
+	return c.WithOrgID(orgID).TeamMembers(teamID)
+}
+
+func (c gapiClient) AddOrgTeamMember(orgID, teamID, userID int64) error {
+	return c.WithOrgID(orgID).AddTeamMember(teamID, userID)
+}
+
+// OrgByName returns the ID of the org called name.
+func (c *Client) OrgByName(ctx context.Context, name string) (id int64, err error) {
+	ctx, end := c.instrument(ctx, "OrgByName")
+	defer func() { end(err) }()
+
+	err = c.call(ctx, true, func() error {
+		org, err := c.client.OrgByName(name)
+		id = org.ID
+		return newAPIError(err, statusErrors{http.StatusNotFound: ErrOrgNotFound})
+	})
+
+	return id, err
+}
+
+// resolveOrgNames returns groups with the orgs and teams referenced by org
+// name referenced by org ID instead. Orgs that don't exist are logged and
+// left out, as the user can still get the rest of its roles.
+func (c *Client) resolveOrgNames(ctx context.Context, groups config.Groups) (config.Groups, error) {
+	ids := make(map[string]int64)
+	lookup := func(name string) (int64, bool, error) {
+		id, ok := ids[name]
+		if !ok {
+			var err error
+			id, err = c.OrgByName(ctx, name)
+			switch {
+			case errors.Is(err, ErrOrgNotFound):
+				logging.FromContext(ctx).WithField("org_name", name).Warn("org not found, its roles and teams are skipped")
+			case err != nil:
+				return 0, false, err
+			}
+			ids[name] = id
+		}
+
+		return id, id != 0, nil
+	}
+
+	resolved := make(config.Groups, len(groups))
+	for groupName, group := range groups {
+		orgs := make([]config.Org, 0, len(group.Orgs))
+		for _, org := range group.Orgs {
+			if org.Name != "" {
+				id, ok, err := lookup(org.Name)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+				org = config.Org{ID: id, Role: org.Role}
+			}
+			orgs = append(orgs, org)
+		}
+
+		var teams []config.Team
+		for _, team := range group.Teams {
+			if team.OrgName != "" {
+				id, ok, err := lookup(team.OrgName)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+				team = config.Team{OrgID: id, Name: team.Name}
+			}
+			teams = append(teams, team)
+		}
+
+		resolved[groupName] = config.Group{GrafanaAdmin: group.GrafanaAdmin, Orgs: orgs, Teams: teams}
+	}
+
+	return resolved, nil
+}
+
+// AddTeamMember adds a user to an existing team of an org, teams are never
+// created and members are never removed. The user has to be a member of the
+// org.
+func (c *Client) AddTeamMember(ctx context.Context, orgID int64, team string, user gapi.User) (err error) {
+	ctx, end := c.instrument(ctx, "AddTeamMember", attribute.Int64("grafana.org_id", orgID), attribute.String("grafana.team", team))
+	defer func() { end(err) }()
+
+	var teams []*gapi.Team
+	err = c.call(ctx, true, func() error {
+		var err error
+		teams, err = c.client.SearchOrgTeam(orgID, team)
+		return newAPIError(err, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the search matches partial names
+	var teamID int64
+	for _, t := range teams {
+		if t.Name == team {
+			teamID = t.ID
+		}
+	}
+	if teamID == 0 {
+		return ErrTeamNotFound
+	}
+
+	// a user that would have been created in dry run is not a member of any
+	// team
+	if user.ID != 0 {
+		var members []*gapi.TeamMember
+		err = c.call(ctx, true, func() error {
+			var err error
+			members, err = c.client.OrgTeamMembers(orgID, teamID)
+			return newAPIError(err, nil)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if member.UserID == user.ID {
+				return nil
+			}
+		}
+	}
+
+	if !c.dryRun {
+		err = c.call(ctx, true, func() error {
+			return newAPIError(c.client.AddOrgTeamMember(orgID, teamID, user.ID), nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.recordChange(ctx, Change{
+		Kind:   CHANGE_TEAM_MEMBER_ADDED,
+		UserID: user.ID,
+		Login:  user.Login,
+		OrgID:  orgID,
+		Team:   team,
+	})
+
+	return nil
+}
+
+// syncTeams adds the user to every team of groups. A team that can't be
+// joined doesn't fail the sync.
+func (c *Client) syncTeams(ctx context.Context, user gapi.User, groups config.Groups) {
+	seen := make(map[config.Team]bool)
+	for _, group := range groups {
+		for _, team := range group.Teams {
+			if seen[team] {
+				continue
+			}
+			seen[team] = true
+
+			if err := c.AddTeamMember(ctx, team.OrgID, team.Name, user); err != nil {
+				logging.FromContext(ctx).WithError(err).WithFields(log.Fields{
+					"org_id": team.OrgID,
+					"team":   team.Name,
+				}).Warn("failed to add user to team")
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package grafana
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/kanopy-platform/grafana-auth-proxy/pkg/grafana")
+
+// startSpan starts a span for operation and returns a function that ends it
+// with the result of the operation.
+func startSpan(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "grafana."+operation, trace.WithAttributes(attrs...))
+
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// instrument is startSpan for operations that call the Grafana API, it also
+// records the operation metrics.
+func (c *Client) instrument(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, end := startSpan(ctx, operation, attrs...)
+
+	return ctx, func(err error) {
+		end(err)
+		c.metrics.observe(operation, start, err)
+	}
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+type fieldsKey struct{}
+
+// NewContext returns a copy of ctx that carries fields in addition to the
+// fields already carried by ctx.
+func NewContext(ctx context.Context, fields log.Fields) context.Context {
+	merged := log.Fields{}
+	for k, v := range fieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FromContext returns a logger with the fields carried by ctx.
+func FromContext(ctx context.Context) *log.Entry {
+	return log.WithContext(ctx).WithFields(fieldsFromContext(ctx))
+}
+
+func fieldsFromContext(ctx context.Context) log.Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(log.Fields)
+	return fields
+}
+
+// SetFormat sets the format of the global logger.
+func SetFormat(format string) error {
+	switch format {
+	case FORMAT_TEXT:
+		log.SetFormatter(&log.TextFormatter{})
+	case FORMAT_JSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("log format %q is not valid, valid values are %q or %q", format, FORMAT_TEXT, FORMAT_JSON)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"context"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Empty(t, FromContext(ctx).Data)
+
+	ctx = NewContext(ctx, log.Fields{"request_id": "1", "path": "/"})
+	child := NewContext(ctx, log.Fields{"login": "jhon", "path": "/login"})
+
+	assert.Equal(t, log.Fields{"request_id": "1", "path": "/"}, FromContext(ctx).Data)
+	assert.Equal(t, log.Fields{"request_id": "1", "path": "/login", "login": "jhon"}, FromContext(child).Data)
+}
+
+func TestSetFormat(t *testing.T) {
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	assert.NoError(t, SetFormat(FORMAT_JSON))
+	assert.IsType(t, &log.JSONFormatter{}, log.StandardLogger().Formatter)
+
+	assert.NoError(t, SetFormat(FORMAT_TEXT))
+	assert.IsType(t, &log.TextFormatter{}, log.StandardLogger().Formatter)
+
+	assert.Error(t, SetFormat("logfmt"))
+}